@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	mesh "github.com/samthor/hangar/lib"
+)
+
+// holdPorts listens on this stopped instance's port range, so that a connection starts it, like socket activation.
+// Does nothing if the instance is running, failed or destroyed, or the daemon is shutting down.
+func (i *Instance) holdPorts() {
+	if !*flagSocketActivation || isShuttingDown() {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.runCh != nil || i.failed || i.destroyed || i.held != nil {
+		return
+	}
+
+	for offset := uint16(0); offset < mesh.PortRange; offset++ {
+		network, addr := "tcp6", fmt.Sprintf("[::1]:%d", i.Port+offset)
+		if i.Address.IsValid() {
+			network, addr = "tcp", i.HostPort(offset)
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			continue // probably held by a stale process, reported elsewhere
+		}
+		i.held = append(i.held, ln)
+		go i.acceptHeld(offset, ln)
+	}
+}
+
+// releasePorts closes any listeners from holdPorts. Must be under lock.
+func (i *Instance) releasePorts() {
+	for _, ln := range i.held {
+		ln.Close()
+	}
+	i.held = nil
+}
+
+func (i *Instance) acceptHeld(offset uint16, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // released
+		}
+		go i.wake(offset, conn)
+	}
+}
+
+// wake starts this instance for a connection on a held port, then hands the connection over once the app listens.
+func (i *Instance) wake(offset uint16, conn net.Conn) {
+	defer conn.Close()
+
+	if isShuttingDown() {
+		return
+	}
+	if i.EnsureRun() {
+		i.wakeups.Add(1)
+		log.Printf("machine=%s woken by connection to port=%d from %v", i.MachineId, i.Port+offset, conn.RemoteAddr())
+	}
+
+	check := Check{Type: "tcp", Offset: offset, Timeout: readyPollInterval * 4}
+	deadline := time.Now().Add(*flagStartTimeout)
+	for check.do(i.Host(), i.Port) != nil {
+		if !i.Active() || time.Now().After(deadline) {
+			log.Printf("machine=%s didn't listen on port=%d after wake", i.MachineId, i.Port+offset)
+			refuse(conn)
+			return
+		}
+		time.Sleep(readyPollInterval)
+	}
+
+	out, err := net.Dial("tcp", i.HostPort(offset))
+	if err != nil {
+		refuse(conn)
+		return
+	}
+	defer out.Close()
+	pipeConns(conn, out)
+}
+
+// pipeConns copies between both connections until both directions are closed.
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{})
+	copyHalf := func(to, from net.Conn) {
+		io.Copy(to, from)
+		if tcp, ok := to.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			to.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
+
+// isShuttingDown returns whether the daemon is shutting down.
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	autoscaleInterval = time.Second
+)
+
+// autoscale keeps min machines running in the default region, restarting any which stop, and starts stopped machines
+// in regions where every running machine is at its soft limit. Returns when the daemon shuts down.
+func (ro *Router) autoscale(min int) {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shuttingDown:
+			return
+		case <-ticker.C:
+		}
+
+		if ro.buildFailed() {
+			continue // machines would only fail to start, wait for requests to retry the build
+		}
+		for _, app := range ro.apps() {
+			ro.autoscaleApp(app, min)
+		}
+	}
+}
+
+// autoscaleApp starts machines in each of the app's regions as needed. Only the public app has a minimum.
+func (ro *Router) autoscaleApp(app string, min int) {
+	if app != ro.app {
+		min = 0
+	}
+
+	for region, options := range ro.table(app, nil) {
+		var running, busy int
+		var stopped InstanceList
+		for _, i := range options {
+			if i.IsAlive() {
+				running++
+				if i.Requests() >= ro.concurrency.SoftLimit {
+					busy++
+				}
+			} else if !i.Active() && !i.IsFailed() {
+				stopped = append(stopped, i)
+			}
+		}
+
+		want := 0
+		if region == ro.defaultRegion {
+			want = min
+		}
+		if *flagAutoStart && running > 0 && busy == running {
+			want = max(want, running+1)
+		}
+
+		for ; running < want && len(stopped) != 0; running++ {
+			i := stopped[0]
+			stopped = stopped[1:]
+			log.Printf("machine=%s autostarting (region=%s running=%d busy=%d min=%d)", i.MachineId, region, running, busy, min)
+			i.EnsureRun()
+		}
+	}
+}
+
+// spareRunning returns how many machines in the default region can be stopped while keeping min running.
+func (ro *Router) spareRunning(min int) int {
+	var running int
+	for _, i := range ro.table(ro.app, nil)[ro.defaultRegion] {
+		if i.IsAlive() {
+			running++
+		}
+	}
+	return running - min
+}
+
+// buildFailed returns whether any of the router's builds last failed.
+func (ro *Router) buildFailed() bool {
+	for _, b := range ro.builds {
+		if b.Err() != nil {
+			return true
+		}
+	}
+	return false
+}
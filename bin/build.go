@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// buildCheckInterval throttles how often sources are re-hashed when machines start.
+	buildCheckInterval = time.Second
+	// buildTmpExpiry is when partial builds are removed, as another daemon may still be writing them.
+	buildTmpExpiry = time.Hour
+)
+
+// listTemplate prints the full path of every non-standard package's source files (and its go.mod) for hashing, one per line.
+const listTemplate = `{{if not .Standard}}{{range .GoFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .CgoFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .CFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .HFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .SFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .EmbedFiles}}{{$.Dir}}/{{.}}
+{{end}}{{with .Module}}{{if .GoMod}}{{.GoMod}}
+{{end}}{{end}}{{end}}`
+
+// Build compiles a Go package once into a cache directory, and reuses that binary for every machine.
+// The binary is only rebuilt when the package's sources (or the build flags) change.
+type Build struct {
+	Package  string
+	Flags    []string // extra flags for "go build", e.g. "-race"
+	CacheDir string
+
+	checkLock sync.Mutex // held while hashing and building, so only one check runs at a time
+
+	lock    sync.Mutex // guards the result of the last check, never held while hashing or building
+	checked time.Time  // when the last check started
+	hash    string
+	binary  string
+	err     *BuildError
+	errHash string // sources which caused err, not retried until they change
+}
+
+// BuildError contains the compiler output for a package that failed to build.
+type BuildError struct {
+	Package string
+	Output  string
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("could not build package=%s", e.Package)
+}
+
+// Err returns the last build error, if the package is currently failing to build. It doesn't wait for a build.
+func (b *Build) Err() *BuildError {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+// Binary returns the path to an up-to-date binary, building it if required.
+// If the sources haven't changed since a failed build, returns the same *BuildError.
+func (b *Build) Binary() (string, error) {
+	return b.binarySince(time.Now().Add(-buildCheckInterval))
+}
+
+// Rebuild checks the sources immediately, returning whether a new binary was built.
+func (b *Build) Rebuild() (bool, error) {
+	b.lock.Lock()
+	previous := b.binary
+	b.lock.Unlock()
+
+	binary, err := b.binarySince(time.Now())
+	if err != nil {
+		return false, err
+	}
+	return binary != previous, nil
+}
+
+// binarySince returns the result of a check started after since, running one if needed.
+// Callers which arrive during a check wait for it rather than starting another.
+func (b *Build) binarySince(since time.Time) (string, error) {
+	if binary, ok, err := b.checkedSince(since); ok {
+		return binary, err
+	}
+
+	b.checkLock.Lock()
+	defer b.checkLock.Unlock()
+	if binary, ok, err := b.checkedSince(since); ok {
+		return binary, err // checked while we waited
+	}
+	return b.check()
+}
+
+// checkedSince returns the result of the last check, if it started after since and its binary still exists.
+func (b *Build) checkedSince(since time.Time) (string, bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.checked.Before(since) {
+		return "", false, nil
+	} else if b.err != nil {
+		return "", true, b.err
+	} else if b.binary != "" && fileExists(b.binary) {
+		return b.binary, true, nil
+	}
+	return "", false, nil
+}
+
+// check hashes the sources and builds them if they've changed. Must be under checkLock, but not lock.
+func (b *Build) check() (string, error) {
+	started := time.Now()
+	hash, hashErr := b.sourceHash()
+
+	b.lock.Lock()
+	b.checked = started
+	if hashErr != nil {
+		b.err = hashErr
+		b.errHash = ""
+		b.lock.Unlock()
+		return "", hashErr
+	}
+	if b.err == nil && hash == b.hash && fileExists(b.binary) {
+		defer b.lock.Unlock()
+		return b.binary, nil
+	} else if b.err != nil && hash == b.errHash {
+		defer b.lock.Unlock()
+		return "", b.err
+	}
+	b.lock.Unlock()
+
+	// daemons with other flags would remove each other's builds from a shared directory
+	dir := filepath.Join(b.CacheDir, shortHash(b.Package+"\x00"+strings.Join(b.Flags, "\x00")))
+	binary := filepath.Join(dir, hash)
+
+	if !fileExists(binary) {
+		if err := b.build(binary); err != nil {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.err = err
+			b.errHash = hash
+			return "", err
+		}
+	} else {
+		log.Printf("reusing build of package=%s (%s)", b.Package, binary)
+	}
+
+	// remove older builds of this package, but not partial builds unless they've been abandoned
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			if e.Name() == hash {
+				continue
+			} else if strings.Contains(e.Name(), ".tmp") {
+				if info, err := e.Info(); err != nil || time.Since(info.ModTime()) < buildTmpExpiry {
+					continue
+				}
+			}
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.hash = hash
+	b.binary = binary
+	b.err = nil
+	b.errHash = ""
+	return binary, nil
+}
+
+// ModuleDir returns the root directory of the module containing the package.
+func (b *Build) ModuleDir() (string, error) {
+	out, err := exec.Command("go", "list", "-f", "{{with .Module}}{{.Dir}}{{end}}", b.Package).Output()
+	if err != nil {
+		return "", fmt.Errorf("could not find module for package=%s: %w", b.Package, err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if dir == "" {
+		return "", fmt.Errorf("package=%s is not in a module", b.Package)
+	}
+	return dir, nil
+}
+
+func (b *Build) build(binary string) *BuildError {
+	err := os.MkdirAll(filepath.Dir(binary), 0755)
+	if err != nil {
+		return &BuildError{Package: b.Package, Output: err.Error()}
+	}
+
+	start := time.Now()
+	log.Printf("building package=%s flags=%v...", b.Package, b.Flags)
+
+	tmp := fmt.Sprintf("%s.tmp%d", binary, os.Getpid())
+	args := append([]string{"build", "-o", tmp}, b.Flags...)
+	args = append(args, b.Package)
+
+	var output bytes.Buffer
+	e := exec.Command("go", args...)
+	e.Stdout = io.MultiWriter(os.Stdout, &output)
+	e.Stderr = io.MultiWriter(os.Stderr, &output)
+	err = e.Run()
+	if err == nil {
+		err = os.Rename(tmp, binary)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("could not build package=%s: %v", b.Package, err)
+		if output.Len() == 0 {
+			output.WriteString(err.Error())
+		}
+		return &BuildError{Package: b.Package, Output: output.String()}
+	}
+
+	log.Printf("built package=%s in %v", b.Package, time.Since(start))
+	return nil
+}
+
+// sourceHash hashes the names, sizes and modification times of all the package's non-standard sources.
+func (b *Build) sourceHash() (string, *BuildError) {
+	args := append([]string{"list", "-deps", "-f", listTemplate}, b.Flags...)
+	args = append(args, b.Package)
+
+	var stderr bytes.Buffer
+	e := exec.Command("go", args...)
+	e.Stderr = &stderr
+	out, err := e.Output()
+	if err != nil {
+		if stderr.Len() == 0 {
+			stderr.WriteString(err.Error())
+		}
+		return "", &BuildError{Package: b.Package, Output: stderr.String()}
+	}
+
+	version, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		return "", &BuildError{Package: b.Package, Output: err.Error()}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%v\n", version, b.Flags)
+
+	for _, p := range strings.Split(string(out), "\n") {
+		if p == "" {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			fmt.Fprintf(h, "%s missing\n", p)
+			continue
+		}
+		fmt.Fprintf(h, "%s %d %d\n", p, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func shortHash(s string) string {
+	cwd, _ := os.Getwd()
+	h := sha256.Sum256([]byte(cwd + "\x00" + s))
+	return hex.EncodeToString(h[:8])
+}
+
+// fileExists returns whether path exists, e.g., a cached binary that might have been removed.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
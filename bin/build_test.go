@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSourceHashSpaces(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "My Proj")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/proj\n\ngo 1.21\n"), 0644)
+	main := filepath.Join(dir, "main.go")
+	os.WriteFile(main, []byte("package main\n\nfunc main() {}\n"), 0644)
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+
+	b := &Build{Package: "."}
+	before, err := b.sourceHash()
+	if err != nil {
+		t.Fatalf("could not hash: %v", err.Output)
+	}
+
+	os.WriteFile(main, []byte("package main\n\nfunc main() { println() }\n"), 0644)
+	os.Chtimes(main, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	after, err := b.sourceHash()
+	if err != nil {
+		t.Fatalf("could not hash: %v", err.Output)
+	}
+	if before == after {
+		t.Errorf("hash didn't change after editing %s", main)
+	}
+}
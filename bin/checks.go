@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CheckPassing  = "passing"
+	CheckWarning  = "warning"
+	CheckCritical = "critical"
+
+	checkStartInterval = time.Millisecond * 250 // between checks until the first passes
+)
+
+// Check is a Fly-style health check run against every running machine.
+type Check struct {
+	Name        string
+	Type        string // "http" or "tcp"
+	Offset      uint16 // port offset from the machine's port
+	Method      string
+	Path        string
+	Interval    time.Duration
+	Timeout     time.Duration
+	GracePeriod time.Duration
+}
+
+type CheckStatus struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Status  string    `json:"status"`
+	Output  string    `json:"output,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// checkFlag collects repeated -check flags.
+type checkFlag []Check
+
+func (cf *checkFlag) String() string {
+	return fmt.Sprintf("%d checks", len(*cf))
+}
+
+func (cf *checkFlag) Set(raw string) error {
+	c, err := parseCheck(raw)
+	if err != nil {
+		return err
+	}
+	if c.Name == "" {
+		c.Name = fmt.Sprintf("%s-%d", c.Type, len(*cf))
+	}
+	*cf = append(*cf, c)
+	return nil
+}
+
+// parseCheck parses a record like "type=http;path=/healthz;interval=10s".
+func parseCheck(raw string) (Check, error) {
+	var record struct {
+		Name        string `json:"name"`
+		Type        string `json:"type"`
+		Offset      string `json:"offset"`
+		Method      string `json:"method"`
+		Path        string `json:"path"`
+		Interval    string `json:"interval"`
+		Timeout     string `json:"timeout"`
+		GracePeriod string `json:"grace_period"`
+	}
+	err := parseRecord(raw, &record)
+	if err != nil {
+		return Check{}, err
+	}
+
+	c := Check{
+		Name:        record.Name,
+		Type:        strings.ToLower(record.Type),
+		Method:      strings.ToUpper(record.Method),
+		Path:        record.Path,
+		Interval:    time.Second * 15,
+		Timeout:     time.Second * 2,
+		GracePeriod: 0,
+	}
+	if c.Type == "" {
+		c.Type = "http"
+		if c.Path == "" {
+			c.Type = "tcp"
+		}
+	}
+	if c.Type != "http" && c.Type != "tcp" {
+		return Check{}, fmt.Errorf("unknown check type: %q", record.Type)
+	}
+	if c.Type == "http" && c.Path == "" {
+		c.Path = "/"
+	}
+	if c.Method == "" {
+		c.Method = http.MethodGet
+	}
+
+	if record.Offset != "" {
+		_, err := fmt.Sscanf(record.Offset, "%d", &c.Offset)
+		if err != nil {
+			return Check{}, fmt.Errorf("bad check offset: %q", record.Offset)
+		}
+	}
+	for _, d := range []struct {
+		raw string
+		out *time.Duration
+	}{
+		{record.Interval, &c.Interval},
+		{record.Timeout, &c.Timeout},
+		{record.GracePeriod, &c.GracePeriod},
+	} {
+		if d.raw == "" {
+			continue
+		}
+		*d.out, err = time.ParseDuration(d.raw)
+		if err != nil {
+			return Check{}, err
+		}
+	}
+
+	return c, nil
+}
+
+// checkState tracks the result of one Check against one machine.
+type checkState struct {
+	check Check
+
+	lock    sync.Mutex
+	status  string
+	output  string
+	updated time.Time
+}
+
+func (cs *checkState) set(status, output string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.status = status
+	cs.output = output
+	cs.updated = time.Now()
+}
+
+func (cs *checkState) Status() CheckStatus {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return CheckStatus{
+		Name:    cs.check.Name,
+		Type:    cs.check.Type,
+		Status:  cs.status,
+		Output:  cs.output,
+		Updated: cs.updated,
+	}
+}
+
+// run checks until done is closed. Failures during the grace period are only a warning.
+// Like Fly, the first check waits for the grace period (or until the machine is ready), then checks are retried
+// quickly until one passes, so new machines are routed to soon after starting.
+func (cs *checkState) run(host string, port uint16, started time.Time, ready, done <-chan struct{}) {
+	cs.set(CheckWarning, "waiting for first check")
+
+	select {
+	case <-done:
+		return
+	case <-ready:
+	case <-time.After(cs.check.GracePeriod):
+	}
+
+	passed := false
+	for {
+		err := cs.check.do(host, port)
+		if err == nil {
+			passed = true
+			cs.set(CheckPassing, "")
+		} else if time.Since(started) < cs.check.GracePeriod {
+			cs.set(CheckWarning, err.Error())
+		} else {
+			cs.set(CheckCritical, err.Error())
+		}
+
+		interval := cs.check.Interval
+		if !passed {
+			interval = min(interval, checkStartInterval)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// do runs this check once against the given machine host and port.
+func (c *Check) do(host string, port uint16) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port+c.Offset)))
+
+	if c.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", addr, c.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, c.Method, fmt.Sprintf("http://%s%s", addr, c.Path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %d", c.Method, c.Path, resp.StatusCode)
+	}
+	return nil
+}
+
+// worstStatus aggregates check results: any critical is critical, then any warning.
+func worstStatus(checks []CheckStatus) string {
+	out := CheckPassing
+	for _, c := range checks {
+		if c.Status == CheckCritical {
+			return CheckCritical
+		} else if c.Status == CheckWarning {
+			out = CheckWarning
+		}
+	}
+	return out
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	mesh "github.com/samthor/hangar/lib"
+)
+
+// Cluster holds every machine. Machines can be created and destroyed while the daemon runs.
+type Cluster struct {
+	Router    *Router
+	Groups    []*Group
+	PortStart uint        // the first machine's port, each machine has mesh.PortRange ports
+	MaxPort   uint        // machines' ports are below this
+	Peers     *PeerNet    // nil if peers connect directly
+	Private   *PrivateNet // nil if machines share "::1" and each have a port range
+	DNSAddr   string      // of the .internal DNS server, if running
+	Rand      rand.Source
+
+	lock      sync.RWMutex
+	instances []*Instance
+	destroyed map[string]*Instance // kept so their state can still be read
+}
+
+// Instances returns every machine which hasn't been destroyed.
+func (c *Cluster) Instances() []*Instance {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]*Instance(nil), c.instances...)
+}
+
+// Lookup finds a machine by ID, including destroyed machines. Returns nil if unknown.
+func (c *Cluster) Lookup(machine string) *Instance {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, i := range c.instances {
+		if i.MachineId == machine {
+			return i
+		}
+	}
+	return c.destroyed[machine]
+}
+
+// Group finds an app's process group by name. Returns nil if unknown.
+func (c *Cluster) Group(app, name string) *Group {
+	for _, g := range c.Groups {
+		if g.App == app && g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// HasApp returns whether any process group is part of this app.
+func (c *Cluster) HasApp(app string) bool {
+	for _, g := range c.Groups {
+		if g.App == app {
+			return true
+		}
+	}
+	return false
+}
+
+// ByAddr finds a machine by its own address. Returns nil if unknown, or if machines share an address.
+func (c *Cluster) ByAddr(addr netip.Addr) *Instance {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, i := range c.instances {
+		if i.Address.IsValid() && i.Address == addr.Unmap() {
+			return i
+		}
+	}
+	return nil
+}
+
+// Add creates a stopped machine in the group and region, using the lowest free port range (or address).
+func (c *Cluster) Add(g *Group, region string) (*Instance, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	used := make(map[uint16]bool)
+	usedAddrs := make(map[netip.Addr]bool)
+	ids := make(map[string]bool)
+	for _, i := range c.instances {
+		used[i.Port] = true
+		usedAddrs[i.Address] = true
+		ids[i.MachineId] = true
+	}
+	for id := range c.destroyed {
+		ids[id] = true
+	}
+
+	var addr netip.Addr
+	port := c.PortStart
+	if c.Private != nil {
+		for n := 0; !addr.IsValid() || usedAddrs[addr]; n++ {
+			addr = c.Private.Machine(n)
+		}
+		if err := c.Private.Ensure(addr); err != nil {
+			return nil, err
+		}
+		port = privatePort
+	} else {
+		for used[uint16(port)] {
+			port += mesh.PortRange
+		}
+		if port+mesh.PortRange > c.MaxPort {
+			return nil, fmt.Errorf("no ports left for another machine (%d ports each, max=%d)", mesh.PortRange, c.MaxPort)
+		}
+	}
+
+	var machineId string
+	for machineId == "" || ids[machineId] {
+		machineNo := uint64(c.Rand.Int63()) >> 31
+		machineId = fmt.Sprintf("%0x", machineNo)
+		for len(machineId) < 8 {
+			machineId = "0" + machineId
+		}
+	}
+
+	i := &Instance{
+		ControlPort:    uint16(*flagPort),
+		DNSAddr:        c.DNSAddr,
+		Address:        addr,
+		Port:           uint16(port),
+		Region:         region,
+		Group:          g.Name,
+		Command:        g.Command,
+		Build:          g.Build,
+		Args:           g.Args,
+		Env:            g.Env,
+		App:            g.App,
+		MachineId:      machineId,
+		Restart:        g.Restart,
+		Logs:           &LogBuffer{Size: *flagLogLines},
+		Checks:         g.Checks,
+		ReadyPath:      *flagReadyPath,
+		ConnPerRequest: c.Router.concurrency.Type == "connections",
+		Created:        time.Now(),
+	}
+	c.instances = append(c.instances, i)
+	if g.HTTP {
+		c.Router.add(i)
+	}
+	prepareMounts(i, g.Mounts)
+	reportStale(i)
+	i.holdPorts()
+
+	log.Printf("generated machine=%s (app=%s group=%s region=%s addr=%s)", i.MachineId, g.App, g.Name, i.Region, i.HostPort(0))
+	return i, nil
+}
+
+// Remove drains a machine of requests, then destroys it.
+func (c *Cluster) Remove(i *Instance, sig os.Signal, timeout time.Duration) {
+	c.Router.remove(i)
+	i.Drain(timeout)
+	c.Destroy(i, sig, timeout)
+}
+
+// Destroy stops a machine and removes it from the cluster and routing.
+func (c *Cluster) Destroy(i *Instance, sig os.Signal, timeout time.Duration) {
+	c.Router.remove(i)
+	i.Destroy(sig, timeout)
+	if c.Peers != nil {
+		c.Peers.Forget(i)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for index, other := range c.instances {
+		if other == i {
+			c.instances = append(c.instances[:index:index], c.instances[index+1:]...)
+			break
+		}
+	}
+	if c.destroyed == nil {
+		c.destroyed = make(map[string]*Instance)
+	}
+	c.destroyed[i.MachineId] = i
+	log.Printf("destroyed machine=%s", i.MachineId)
+}
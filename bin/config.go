@@ -0,0 +1,314 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	mesh "github.com/samthor/hangar/lib"
+)
+
+const (
+	// flyAutoStopIdle is used for -idle when fly.toml has auto_stop_machines, as Fly checks every few minutes.
+	flyAutoStopIdle = time.Minute
+)
+
+type flyConfig struct {
+	App           string                 `toml:"app"`
+	PrimaryRegion string                 `toml:"primary_region"`
+	KillSignal    string                 `toml:"kill_signal"`
+	KillTimeout   interface{}            `toml:"kill_timeout"` // seconds or a duration
+	Env           map[string]interface{} `toml:"env"`
+	Processes     map[string]string      `toml:"processes"`
+	HTTPService   *flyHTTPService        `toml:"http_service"`
+	Checks        map[string]flyCheck    `toml:"checks"`
+	Mounts        toml.Primitive         `toml:"mounts"` // either a table or an array of tables, decoded into mounts
+
+	mounts []flyMount
+}
+
+type flyHTTPService struct {
+	InternalPort       int         `toml:"internal_port"`
+	AutoStopMachines   interface{} `toml:"auto_stop_machines"` // bool, or "off", "stop" or "suspend"
+	AutoStartMachines  *bool       `toml:"auto_start_machines"`
+	MinMachinesRunning int         `toml:"min_machines_running"`
+	Processes          []string    `toml:"processes"`
+	Concurrency        *struct {
+		Type      string `toml:"type"`
+		SoftLimit int    `toml:"soft_limit"`
+		HardLimit int    `toml:"hard_limit"`
+	} `toml:"concurrency"`
+	Checks []flyCheck `toml:"checks"`
+}
+
+type flyCheck struct {
+	Type        string `toml:"type"`
+	Port        int    `toml:"port"`
+	Path        string `toml:"path"`
+	Method      string `toml:"method"`
+	Interval    string `toml:"interval"`
+	Timeout     string `toml:"timeout"`
+	GracePeriod string `toml:"grace_period"`
+}
+
+type flyMount struct {
+	Source      string   `toml:"source"`
+	Destination string   `toml:"destination"`
+	Processes   []string `toml:"processes"`
+}
+
+// loadFlyConfig reads a fly.toml, logging a warning for every key that hangar can't emulate.
+func loadFlyConfig(path string) (*flyConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, unknown, err := decodeFlyConfig(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("fly.toml: %w", err)
+	}
+	for _, key := range unknown {
+		log.Printf("fly.toml: can't emulate %s, ignoring", key)
+	}
+	return cfg, nil
+}
+
+// decodeFlyConfig decodes a fly.toml, also returning the keys which aren't part of flyConfig.
+func decodeFlyConfig(raw string) (*flyConfig, []string, error) {
+	var cfg flyConfig
+	md, err := toml.Decode(raw, &cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if md.IsDefined("mounts") {
+		if md.Type("mounts") == "Hash" {
+			cfg.mounts = []flyMount{{}}
+			err = md.PrimitiveDecode(cfg.Mounts, &cfg.mounts[0])
+		} else {
+			err = md.PrimitiveDecode(cfg.Mounts, &cfg.mounts)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad [mounts]: %w", err)
+		}
+	}
+
+	var unknown []string
+	for _, key := range md.Undecoded() {
+		unknown = append(unknown, key.String())
+	}
+	sort.Strings(unknown)
+
+	// only report a table, not every key within it
+	out := unknown[:0]
+	for _, key := range unknown {
+		if len(out) == 0 || !strings.HasPrefix(key, out[len(out)-1]+".") {
+			out = append(out, key)
+		}
+	}
+	return &cfg, out, nil
+}
+
+// applyFlags sets flags derived from this config, unless they were set on the command-line.
+func (cfg *flyConfig) applyFlags() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	setDefault := func(name, value string) {
+		if set[name] || value == "" {
+			return
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Fatalf("fly.toml: bad value for -%s: %v", name, err)
+		}
+	}
+
+	setDefault("app", cfg.App)
+	setDefault("kill-signal", cfg.KillSignal)
+
+	switch timeout := cfg.KillTimeout.(type) {
+	case int64:
+		setDefault("kill-timeout", (time.Duration(timeout) * time.Second).String())
+	case string:
+		setDefault("kill-timeout", timeout)
+	}
+
+	if cfg.PrimaryRegion != "" {
+		regions := []string{strings.ToLower(cfg.PrimaryRegion)}
+		for _, r := range strings.Split(flag.Lookup("r").DefValue, ",") {
+			if r != regions[0] {
+				regions = append(regions, r)
+			}
+		}
+		setDefault("r", strings.Join(regions, ","))
+	}
+
+	if hs := cfg.HTTPService; hs != nil {
+		switch stop := hs.AutoStopMachines.(type) {
+		case bool:
+			if stop {
+				setDefault("idle", flyAutoStopIdle.String())
+			}
+		case string:
+			if stop == "stop" || stop == "suspend" {
+				setDefault("idle", flyAutoStopIdle.String())
+			}
+		}
+		if hs.AutoStartMachines != nil {
+			setDefault("auto-start", fmt.Sprintf("%v", *hs.AutoStartMachines))
+		}
+		if hs.MinMachinesRunning > 0 {
+			setDefault("min-running", fmt.Sprintf("%d", hs.MinMachinesRunning))
+		}
+		if c := hs.Concurrency; c != nil {
+			setDefault("concurrency", c.Type)
+			if c.SoftLimit > 0 {
+				setDefault("load", fmt.Sprintf("%d", c.SoftLimit))
+			}
+			if c.HardLimit > 0 {
+				setDefault("hard-limit", fmt.Sprintf("%d", c.HardLimit))
+			}
+		}
+	}
+}
+
+// internalPort returns the port the app listens on in production.
+func (cfg *flyConfig) internalPort() int {
+	if cfg.HTTPService != nil && cfg.HTTPService.InternalPort != 0 {
+		return cfg.HTTPService.InternalPort
+	}
+	return 8080
+}
+
+// httpProcesses returns the process groups which the public router sends requests to.
+func (cfg *flyConfig) httpProcesses() map[string]bool {
+	out := map[string]bool{defaultGroup: true}
+	if cfg.HTTPService != nil && len(cfg.HTTPService.Processes) != 0 {
+		out = make(map[string]bool)
+		for _, p := range cfg.HTTPService.Processes {
+			out[p] = true
+		}
+	}
+	return out
+}
+
+// env returns the [env] section as "KEY=value" pairs.
+func (cfg *flyConfig) env() []string {
+	var out []string
+	for key, value := range cfg.Env {
+		out = append(out, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checks converts [checks], and [[http_service.checks]] for HTTP groups, so their ports are offsets from the internal port.
+func (cfg *flyConfig) checks(http bool) ([]Check, error) {
+	type named struct {
+		name  string
+		check flyCheck
+	}
+	var all []named
+	for name, c := range cfg.Checks {
+		all = append(all, named{name, c})
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].name < all[b].name })
+	if cfg.HTTPService != nil && http {
+		for index, c := range cfg.HTTPService.Checks {
+			c.Type = "http"
+			all = append(all, named{fmt.Sprintf("servicecheck-%02d-http-%d", index, cfg.internalPort()), c})
+		}
+	}
+
+	var out []Check
+	for _, n := range all {
+		port := n.check.Port
+		if port == 0 {
+			port = cfg.internalPort()
+		}
+		offset := port - cfg.internalPort()
+		if offset < 0 || offset >= mesh.PortRange {
+			return nil, fmt.Errorf("check %s: port %d is outside the machine's port range", n.name, port)
+		}
+
+		raw := fmt.Sprintf("name=%s;type=%s;offset=%d;path=%s;method=%s;interval=%s;timeout=%s;grace_period=%s",
+			n.name, n.check.Type, offset, n.check.Path, n.check.Method, n.check.Interval, n.check.Timeout, n.check.GracePeriod)
+		c, err := parseCheck(raw)
+		if err != nil {
+			return nil, fmt.Errorf("check %s: %w", n.name, err)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// groups returns the [processes] as process groups. With a package, each runs its binary with the process's args.
+func (cfg *flyConfig) groups(pkg string, count int) []*Group {
+	var names []string
+	for name := range cfg.Processes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	httpProcesses := cfg.httpProcesses()
+	var out []*Group
+	for _, name := range names {
+		command := strings.Fields(cfg.Processes[name])
+		g := &Group{
+			Name:    name,
+			Command: command,
+			Count:   count,
+			HTTP:    httpProcesses[name],
+		}
+		if pkg == "" && len(command) == 0 {
+			log.Fatalf("fly.toml: process group=%s has no command", name)
+		} else if pkg != "" {
+			g.Command = nil
+			g.Package = pkg
+			if len(command) > 1 {
+				g.Args = command[1:]
+			}
+		}
+		out = append(out, g)
+	}
+	return out
+}
+
+// mountsFor returns the [mounts] for machines in the process group.
+func (cfg *flyConfig) mountsFor(group string) []flyMount {
+	var out []flyMount
+	for _, m := range cfg.mounts {
+		if len(m.Processes) == 0 || containsString(m.Processes, group) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// prepareMounts creates the machine's local directory for each mount, matching lib's StoragePath.
+func prepareMounts(i *Instance, mounts []flyMount) {
+	home := os.Getenv("HOME")
+	for _, m := range mounts {
+		dir := filepath.Join(home, ".fly/hangar", i.MachineId, "mount", filepath.Join("/", m.Destination))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("could not create mount=%s for machine=%s: %v", m.Source, i.MachineId, err)
+			continue
+		}
+		log.Printf("mounted source=%s at %s for machine=%s (%s)", m.Source, m.Destination, i.MachineId, dir)
+	}
+}
+
+func containsString(all []string, s string) bool {
+	for _, x := range all {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
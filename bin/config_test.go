@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFlyConfig(t *testing.T) {
+	raw := `
+app = "hangar-demo"
+kill_timeout = 5
+unsupported = true
+
+[env]
+  MAX_CONNS = 1000000
+  RATIO = 0.5
+  LOG_LEVEL = "debug"
+
+[http_service]
+  internal_port = 8080
+  min_machines_running = 1
+  force_https = true
+
+  [http_service.concurrency]
+    type = "requests"
+    hard_limit = 25
+
+[checks.alive]
+  type = "tcp"
+  headers = { a = "b" }
+
+[mounts]
+  source = "data"
+  destination = "/data"
+`
+
+	cfg, unknown, err := decodeFlyConfig(raw)
+	if err != nil {
+		t.Fatalf("could not decode: %v", err)
+	}
+
+	expectedEnv := []string{"LOG_LEVEL=debug", "MAX_CONNS=1000000", "RATIO=0.5"}
+	if env := cfg.env(); !reflect.DeepEqual(env, expectedEnv) {
+		t.Errorf("bad env: wanted=%v, got=%v", expectedEnv, env)
+	}
+	if cfg.KillTimeout != int64(5) || cfg.HTTPService.Concurrency.HardLimit != 25 {
+		t.Errorf("bad values: kill_timeout=%v, http_service=%+v", cfg.KillTimeout, cfg.HTTPService)
+	}
+	expectedMounts := []flyMount{{Source: "data", Destination: "/data"}}
+	if !reflect.DeepEqual(cfg.mounts, expectedMounts) {
+		t.Errorf("bad mounts: wanted=%+v, got=%+v", expectedMounts, cfg.mounts)
+	}
+
+	expectedUnknown := []string{"checks.alive.headers", "http_service.force_https", "unsupported"}
+	if !reflect.DeepEqual(unknown, expectedUnknown) {
+		t.Errorf("bad unknown keys: wanted=%v, got=%v", expectedUnknown, unknown)
+	}
+}
+
+func TestDecodeFlyConfigMounts(t *testing.T) {
+	raw := `
+[[mounts]]
+  source = "a"
+  destination = "/a"
+  processes = ["app"]
+
+[[mounts]]
+  source = "b"
+  destination = "/b"
+`
+
+	cfg, unknown, err := decodeFlyConfig(raw)
+	if err != nil || len(unknown) != 0 {
+		t.Fatalf("could not decode: err=%v unknown=%v", err, unknown)
+	}
+	if len(cfg.mounts) != 2 || cfg.mounts[0].Processes[0] != "app" || cfg.mounts[1].Source != "b" {
+		t.Errorf("bad mounts: %+v", cfg.mounts)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	mesh "github.com/samthor/hangar/lib"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+
+	dnsTTL        = 5
+	dnsMinUDPSize = 512
+	dnsMaxMessage = 65535
+)
+
+var errDNSFormat = errors.New("malformed dns message")
+
+// DNSServer answers Fly's .internal names from the cluster's machines, over UDP and TCP.
+// Machines get its address as $LOCAL_DNS_ADDR, so lib discovers peers like it does on Fly.
+type DNSServer struct {
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+type dnsQuestion struct {
+	name   string // lowercase, without the trailing dot
+	qtype  uint16
+	qclass uint16
+}
+
+// Listen binds UDP and TCP on the same address, and serves until the daemon exits.
+func (ds *DNSServer) Listen(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// use the same port for TCP, in case addr asked for any port
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	ds.udp = udp
+	ds.tcp = tcp
+
+	go ds.serveUDP()
+	go ds.serveTCP()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (ds *DNSServer) Addr() string {
+	return ds.udp.LocalAddr().String()
+}
+
+func (ds *DNSServer) serveUDP() {
+	buf := make([]byte, dnsMaxMessage)
+	for {
+		n, from, err := ds.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if out := ds.handle(buf[:n], from, true); out != nil {
+			ds.udp.WriteTo(out, from)
+		}
+	}
+}
+
+func (ds *DNSServer) serveTCP() {
+	for {
+		conn, err := ds.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go ds.serveConn(conn)
+	}
+}
+
+// serveConn answers length-prefixed queries on a TCP connection until it's closed.
+func (ds *DNSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size uint16
+		if binary.Read(conn, binary.BigEndian, &size) != nil {
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+
+		out := ds.handle(msg, conn.RemoteAddr(), false)
+		if out == nil {
+			return
+		}
+		out = append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response to a query, or nil if it's not worth responding to.
+// UDP responses over the client's size are truncated, so it retries over TCP.
+func (ds *DNSServer) handle(msg []byte, from net.Addr, udp bool) []byte {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return nil // not a query
+	}
+	id := binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:]) & 0x7900 // opcode and RD
+
+	q, udpSize, err := parseDNSQuery(msg)
+	if err != nil {
+		return dnsResponse(id, flags, dnsRcodeFormErr, nil, nil)
+	} else if flags&0x7800 != 0 {
+		return dnsResponse(id, flags, dnsRcodeNotImp, &q, nil)
+	} else if q.qclass != dnsClassIN || !strings.HasSuffix(q.name, ".internal") {
+		return dnsResponse(id, flags, dnsRcodeRefused, &q, nil)
+	}
+
+	ips, txt, rcode := ds.lookup(q.name, from)
+	if rcode != 0 {
+		return dnsResponse(id, flags, rcode, &q, nil)
+	}
+
+	var answers [][]byte
+	switch q.qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		for _, ip := range ips {
+			if ip.Is4() == (q.qtype == dnsTypeA) {
+				answers = append(answers, ip.AsSlice())
+			}
+		}
+	case dnsTypeTXT:
+		if txt != nil {
+			answers = append(answers, dnsTXT(txt))
+		}
+	}
+
+	out := dnsResponse(id, flags, 0, &q, answers)
+	if udp && len(out) > max(udpSize, dnsMinUDPSize) {
+		out = dnsResponse(id, flags|0x0200, 0, &q, nil) // TC
+	}
+	return out
+}
+
+// lookup returns the addresses or TXT record for a .internal name, or the rcode if it can't answer, e.g., NXDOMAIN if there's no such name.
+// Like the control endpoint, machines which aren't running are skipped with -alive-only.
+// If machines have their own addresses, the querying machine is known, and it's given the addresses of its links to peers.
+func (ds *DNSServer) lookup(name string, from net.Addr) ([]netip.Addr, []string, int) {
+	self := ds.machineFor(from)
+	addrs := func(instances []*Instance) []netip.Addr {
+		return dnsAddrs(self, instances)
+	}
+
+	var instances []*Instance
+	for _, i := range cluster.Instances() {
+		if !*flagAliveOnly || i.IsAlive() {
+			instances = append(instances, i)
+		}
+	}
+	filter := func(fn func(i *Instance) bool) []*Instance {
+		var out []*Instance
+		for _, i := range instances {
+			if fn(i) {
+				out = append(out, i)
+			}
+		}
+		return out
+	}
+
+	if name == "_instances.internal" {
+		var records []string
+		for _, i := range instances {
+			record := fmt.Sprintf("instance=%s,app=%s,ip=%s,region=%s", i.MachineId, i.App, peerAddr(self, i), i.Region)
+			if !i.Address.IsValid() {
+				// machines share an address, so add what lib needs to tell them apart
+				record += fmt.Sprintf(",processGroup=%s,port=%d", i.Group, i.Port)
+			}
+			records = append(records, record)
+		}
+		return nil, []string{strings.Join(records, ";")}, 0
+	}
+
+	// everything else is "<...>.<app>.internal"
+	rest := strings.TrimSuffix(name, ".internal")
+	var prefix, app string
+	if index := strings.LastIndexByte(rest, '.'); index == -1 {
+		app = rest
+	} else {
+		prefix, app = rest[:index], rest[index+1:]
+	}
+	if !cluster.HasApp(app) {
+		return nil, nil, dnsRcodeNXDomain
+	}
+	instances = filter(func(i *Instance) bool { return i.App == app })
+
+	switch {
+	case prefix == "":
+		return addrs(instances), nil, 0
+
+	case prefix == "vms":
+		var vms []string
+		for _, i := range instances {
+			vms = append(vms, fmt.Sprintf("%s %s", i.MachineId, i.Region))
+		}
+		return nil, []string{strings.Join(vms, ",")}, 0
+
+	case prefix == "regions":
+		seen := make(map[string]bool)
+		var regions []string
+		for _, i := range instances {
+			if !seen[i.Region] {
+				seen[i.Region] = true
+				regions = append(regions, i.Region)
+			}
+		}
+		sort.Strings(regions)
+		return nil, []string{strings.Join(regions, ",")}, 0
+
+	case strings.HasSuffix(prefix, ".process"):
+		group := strings.TrimSuffix(prefix, ".process")
+		if cluster.Group(app, group) == nil {
+			return nil, nil, dnsRcodeNXDomain
+		}
+		return addrs(filter(func(i *Instance) bool { return i.App == app && i.Group == group })), nil, 0
+
+	case strings.HasPrefix(prefix, "top") && strings.HasSuffix(prefix, ".nearest.of"):
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(prefix, "top"), ".nearest.of"))
+		if err != nil || n <= 0 {
+			return nil, nil, dnsRcodeNXDomain
+		}
+		if self == nil {
+			// nearest to whom? Answering for the first region would be silently wrong
+			log.Printf("dns: refusing name=%s from=%v, which isn't a known machine (pass -private-ip)", name, from)
+			return nil, nil, dnsRcodeRefused
+		}
+		region := self.Region
+		sort.SliceStable(instances, func(a, b int) bool {
+			return mesh.VirtualLatency(region, instances[a].Region) < mesh.VirtualLatency(region, instances[b].Region)
+		})
+		return addrs(instances[:min(n, len(instances))]), nil, 0
+
+	case !strings.Contains(prefix, "."):
+		// "<region>.<app>.internal"
+		return addrs(filter(func(i *Instance) bool { return i.App == app && i.Region == prefix })), nil, 0
+	}
+
+	return nil, nil, dnsRcodeNXDomain
+}
+
+// machineFor returns the machine making a query, or nil if unknown, e.g., as machines share an address.
+// Queries which depend on the querying machine, like top<N>.nearest.of, are refused from unknown machines.
+func (ds *DNSServer) machineFor(from net.Addr) *Instance {
+	var ap netip.AddrPort
+	if udp, ok := from.(*net.UDPAddr); ok {
+		ap = udp.AddrPort()
+	} else if tcp, ok := from.(*net.TCPAddr); ok {
+		ap = tcp.AddrPort()
+	}
+	return cluster.ByAddr(ap.Addr())
+}
+
+// peerAddr returns the address that self should reach i at: its link to i, if peer traffic is proxied and links have addresses.
+func peerAddr(self, i *Instance) netip.Addr {
+	if self == nil || self == i || cluster.Peers == nil || cluster.Private == nil {
+		return i.PrivateAddr()
+	}
+	l, err := cluster.Peers.Link(self, i)
+	if err != nil {
+		return i.PrivateAddr()
+	}
+	return l.addr
+}
+
+// dnsAddrs returns the unique addresses of these instances, as seen by self (which may be nil).
+func dnsAddrs(self *Instance, instances []*Instance) []netip.Addr {
+	seen := make(map[netip.Addr]bool)
+	var out []netip.Addr
+	for _, i := range instances {
+		addr := peerAddr(self, i)
+		if !seen[addr] {
+			seen[addr] = true
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// dnsTXT encodes TXT data as <=255 byte strings, which clients join back together.
+func dnsTXT(txt []string) []byte {
+	var out []byte
+	for _, s := range txt {
+		for {
+			part := s[:min(len(s), 255)]
+			s = s[len(part):]
+			out = append(out, byte(len(part)))
+			out = append(out, part...)
+			if s == "" {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// parseDNSQuery parses the single question in a query, and the UDP size it advertises via EDNS, if any.
+func parseDNSQuery(msg []byte) (dnsQuestion, int, error) {
+	var q dnsQuestion
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return q, 0, errDNSFormat
+	}
+
+	name, offset, err := parseDNSName(msg, 12)
+	if err != nil || offset+4 > len(msg) {
+		return q, 0, errDNSFormat
+	}
+	q.name = name
+	q.qtype = binary.BigEndian.Uint16(msg[offset:])
+	q.qclass = binary.BigEndian.Uint16(msg[offset+2:])
+	offset += 4
+
+	// look for an OPT record in the additional section, skipping other sections (which are normally empty)
+	var udpSize int
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for n := 0; n < records; n++ {
+		if _, offset, err = parseDNSName(msg, offset); err != nil || offset+10 > len(msg) {
+			return q, 0, errDNSFormat
+		}
+		if binary.BigEndian.Uint16(msg[offset:]) == dnsTypeOPT {
+			udpSize = int(binary.BigEndian.Uint16(msg[offset+2:]))
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(msg[offset+8:]))
+	}
+	return q, udpSize, nil
+}
+
+// parseDNSName parses the uncompressed name at offset, returning it and the offset after it.
+func parseDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		size := int(msg[offset])
+		offset++
+		if size == 0 {
+			break
+		} else if size > 63 || offset+size > len(msg) {
+			return "", 0, errDNSFormat // compressed names aren't sent in queries
+		}
+		labels = append(labels, strings.ToLower(string(msg[offset:offset+size])))
+		offset += size
+	}
+	return strings.Join(labels, "."), offset, nil
+}
+
+// dnsResponse builds a response with these answers' data (as q's type), which must be for q.
+func dnsResponse(id, flags uint16, rcode int, q *dnsQuestion, answers [][]byte) []byte {
+	out := binary.BigEndian.AppendUint16(nil, id)
+	out = binary.BigEndian.AppendUint16(out, 0x8400|flags|uint16(rcode)) // QR, AA
+	if q == nil {
+		return append(out, make([]byte, 8)...)
+	}
+	out = binary.BigEndian.AppendUint16(out, 1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(answers)))
+	out = append(out, 0, 0, 0, 0)
+
+	for _, label := range strings.Split(q.name, ".") {
+		if label == "" {
+			continue // the root
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	out = append(out, 0)
+	out = binary.BigEndian.AppendUint16(out, q.qtype)
+	out = binary.BigEndian.AppendUint16(out, q.qclass)
+
+	for _, data := range answers {
+		out = append(out, 0xc0, 12) // pointer to the question's name
+		out = binary.BigEndian.AppendUint16(out, q.qtype)
+		out = binary.BigEndian.AppendUint16(out, dnsClassIN)
+		out = binary.BigEndian.AppendUint32(out, dnsTTL)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+		out = append(out, data...)
+	}
+	return out
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseDNSQuery(t *testing.T) {
+	msg := []byte{
+		0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1, // header with one question and one additional
+		3, 'V', 'm', 's', 6, 'h', 'a', 'n', 'g', 'a', 'r', 8, 'i', 'n', 't', 'e', 'r', 'n', 'a', 'l', 0,
+		0, dnsTypeTXT, 0, dnsClassIN,
+		0, 0, dnsTypeOPT, 0x04, 0xd0, 0, 0, 0, 0, 0, 0, // OPT advertising 1232 bytes
+	}
+
+	q, udpSize, err := parseDNSQuery(msg)
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	if q.name != "vms.hangar.internal" || q.qtype != dnsTypeTXT || q.qclass != dnsClassIN || udpSize != 1232 {
+		t.Errorf("bad parse: %+v udpSize=%d", q, udpSize)
+	}
+
+	if _, _, err := parseDNSQuery(msg[:20]); err == nil {
+		t.Errorf("expected error for truncated query")
+	}
+}
+
+func TestDNSTXT(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	out := dnsTXT([]string{long})
+
+	if len(out) != 302 || out[0] != 255 || out[256] != 45 {
+		t.Errorf("bad chunks: len=%d", len(out))
+	}
+	if !bytes.Equal(dnsTXT([]string{""}), []byte{0}) {
+		t.Errorf("expected empty string")
+	}
+}
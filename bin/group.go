@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultGroup is the name Fly gives the process group of apps without [processes].
+	defaultGroup = "app"
+)
+
+// Group is a Fly process group: a named program run on some machines, which may or may not serve HTTP.
+type Group struct {
+	App     string // the Fly app, many can run on one daemon
+	Name    string
+	Command []string // argv to run, if not Build
+	Build   *Build   // package to build and run, if set
+	Package string   // package for Build, before it's created
+	Args    []string // extra args for Build's binary
+	Count   int
+	Regions []string
+	HTTP    bool // whether the public router sends requests to this group
+
+	// settings for the group's machines
+	Env     []string
+	Checks  []Check
+	Restart RestartPolicy
+	Mounts  []flyMount
+}
+
+// groupFlag collects repeated -group flags.
+type groupFlag []*Group
+
+func (gf *groupFlag) String() string {
+	return fmt.Sprintf("%d groups", len(*gf))
+}
+
+func (gf *groupFlag) Set(raw string) error {
+	g, err := parseGroup(raw)
+	if err != nil {
+		return err
+	}
+	*gf = append(*gf, g)
+	return nil
+}
+
+// parseGroup parses a record like "name=worker;cmd=node worker.js;count=2;regions=syd,ams;http=false;app=other".
+func parseGroup(raw string) (*Group, error) {
+	var record struct {
+		App     string `json:"app"`
+		Name    string `json:"name"`
+		Package string `json:"package"`
+		Cmd     string `json:"cmd"`
+		Count   string `json:"count"`
+		Regions string `json:"regions"`
+		HTTP    string `json:"http"`
+	}
+	err := parseRecord(raw, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Group{
+		App:     record.App,
+		Name:    record.Name,
+		Package: record.Package,
+		Command: strings.Fields(record.Cmd),
+		Count:   1,
+	}
+	if g.Name == "" {
+		return nil, fmt.Errorf("group needs a name: %q", raw)
+	}
+	if (g.Package == "") == (len(g.Command) == 0) {
+		return nil, fmt.Errorf("group=%s needs one of package= or cmd=", g.Name)
+	}
+
+	if record.Count != "" {
+		g.Count, err = strconv.Atoi(record.Count)
+		if err != nil || g.Count < 0 {
+			return nil, fmt.Errorf("group=%s has bad count: %q", g.Name, record.Count)
+		}
+	}
+	if record.Regions != "" {
+		g.Regions, err = parseRegions(record.Regions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if record.HTTP != "" {
+		g.HTTP, err = strconv.ParseBool(record.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("group=%s has bad http: %q", g.Name, record.HTTP)
+		}
+	}
+
+	return g, nil
+}
+
+// parseRegions parses comma-separated 3-character region codes.
+func parseRegions(raw string) ([]string, error) {
+	regions := strings.Split(strings.ToLower(raw), ",")
+	for i, r := range regions {
+		r = strings.TrimSpace(r)
+		regions[i] = r
+		if len(r) != 3 {
+			return nil, fmt.Errorf("regions must be 3-character codes, had %v", regions)
+		}
+	}
+	return regions, nil
+}
@@ -1,10 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 )
 
+// parseSignal parses a signal name like "SIGINT" or "int", the same as Fly's kill_signal.
+func parseSignal(raw string) (os.Signal, error) {
+	name := strings.ToUpper(strings.TrimSpace(raw))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown signal: %q", raw)
+}
+
 // parseRecord parses a record like "key=value;foo=bar;key=value" into an object.
 func parseRecord(raw string, into interface{}) error {
 	parts := strings.Split(raw, ";")
@@ -24,3 +40,18 @@ func parseRecord(raw string, into interface{}) error {
 	}
 	return json.Unmarshal(tmp, into)
 }
+
+// sleepContext sleeps for d, returning early with the context's error if it's done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,71 +1,247 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	mesh "github.com/samthor/hangar/lib"
 )
 
-type Instance struct {
-	ControlPort uint16
-	Port        uint16
-	Package     string
-	Region      string
-	MachineId   string
+const (
+	logWaitDelay      = time.Millisecond * 500
+	readyPollInterval = time.Millisecond * 25
+	drainPollInterval = time.Millisecond * 50
+)
 
-	active atomic.Int32 // active requests
-	lock   sync.RWMutex
-	runCh  <-chan *exec.ExitError
+type Instance struct {
+	ControlPort    uint16
+	DNSAddr        string     // where to resolve .internal names, if set
+	Address        netip.Addr // this machine's own loopback address, if not shared
+	Port           uint16
+	Command        []string // argv to run, if not Build
+	Build          *Build   // package to build and run, if set
+	Args           []string // extra args for Build's binary
+	Env            []string // extra environment, e.g., from fly.toml
+	App            string
+	Region         string
+	Group          string // the process group
+	MachineId      string
+	Restart        RestartPolicy
+	Logs           *LogBuffer
+	Checks         []Check
+	ReadyPath      string // if set, ready once this returns 2xx, rather than when the port accepts connections
+	ConnPerRequest bool   // don't keep connections alive, for "connections" concurrency
+	Created        time.Time
+
+	active     atomic.Int32 // active requests
+	conns      atomic.Int32 // open connections from the proxy
+	transport  *http.Transport
+	lastActive atomic.Int64 // unix nanos of last request or start
+	lock       sync.RWMutex
+	runCh      <-chan error
+	doneCh     chan struct{} // closed when runCh is cleared
+	stopCh     chan struct{} // closed when Stop is called
+	process    *os.Process
+	stopping   bool
+	draining   bool // out of routing, e.g., during a rolling restart
+	failed     bool
+	destroyed  bool
+	restarts   int // restarts since the instance was last stable
+	startedAt  time.Time
+	exitCode   int
+	checks     []*checkState  // for the current process
+	readyCh    chan struct{}  // closed once the current process is ready
+	exitedCh   chan struct{}  // closed once the current process exits
+	held       []net.Listener // ports held while stopped, for socket activation
+	wakeups    atomic.Int64
 }
 
 func (i *Instance) Requests() int {
 	return int(i.active.Load())
 }
 
+// PrivateAddr returns this machine's address, as in its private IP on Fly.
+func (i *Instance) PrivateAddr() netip.Addr {
+	if i.Address.IsValid() {
+		return i.Address
+	}
+	return netip.IPv6Loopback()
+}
+
+// Host returns the host this machine listens on, which is "localhost" if machines share an address.
+func (i *Instance) Host() string {
+	if i.Address.IsValid() {
+		return i.Address.String()
+	}
+	return "localhost"
+}
+
+// HostPort returns the address to connect to this machine at, plus a port offset.
+func (i *Instance) HostPort(offset uint16) string {
+	return net.JoinHostPort(i.Host(), strconv.Itoa(int(i.Port+offset)))
+}
+
+// Connections returns the number of open connections to this instance, including idle keep-alive connections.
+func (i *Instance) Connections() int {
+	return int(i.conns.Load())
+}
+
+// acquire reserves a request if fewer than limit are in flight (0 for no limit). Requests are released by SendTo.
+func (i *Instance) acquire(limit int) bool {
+	if limit <= 0 {
+		i.active.Add(+1)
+		return true
+	}
+	for {
+		active := i.active.Load()
+		if int(active) >= limit {
+			return false
+		}
+		if i.active.CompareAndSwap(active, active+1) {
+			return true
+		}
+	}
+}
+
+// release ends a request reserved by acquire.
+func (i *Instance) release() {
+	i.lastActive.Store(time.Now().UnixNano())
+	i.active.Add(-1)
+}
+
 func (i *Instance) Active() bool {
 	i.lock.RLock()
 	defer i.lock.RUnlock()
 	return i.runCh != nil
 }
 
-func (i *Instance) run() <-chan *exec.ExitError {
-	closeCh := make(chan *exec.ExitError)
+// IdleFor returns how long this instance has had no active requests.
+func (i *Instance) IdleFor() time.Duration {
+	if i.Requests() != 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, i.lastActive.Load()))
+}
+
+// startError is sent by run when the process could not start at all.
+type startError struct {
+	err error
+}
+
+func (e *startError) Error() string {
+	return fmt.Sprintf("could not start: %v", e.err)
+}
+
+// command returns the command to run, building the binary if needed. Call without the lock, as builds are slow.
+func (i *Instance) command() ([]string, error) {
+	if i.Build == nil {
+		return i.Command, nil
+	}
+	binary, err := i.Build.Binary()
+	if err != nil {
+		log.Printf("could not build for machine=%s, err=%v", i.MachineId, err)
+		return nil, err
+	}
+	return append([]string{binary}, i.Args...), nil
+}
+
+// run starts command, or reports commandErr from resolving it as a startError. Must be under lock.
+func (i *Instance) run(command []string, commandErr error) <-chan error {
+	closeCh := make(chan error, 1)
+	i.process = nil
+	i.startedAt = time.Now()
+	i.lastActive.Store(time.Now().UnixNano())
+
+	fail := func(err error) <-chan error {
+		closeCh <- &startError{err: err}
+		close(closeCh)
+		return closeCh
+	}
+	if commandErr != nil {
+		return fail(commandErr)
+	}
 
 	controlUrl := fmt.Sprintf("http://localhost:%d/__/control?machine=%s", i.ControlPort, i.MachineId)
 
-	e := exec.Command("go", "run", i.Package)
+	e := exec.Command(command[0], command[1:]...)
+	e.Env = append(os.Environ(), i.Env...)
 	e.Env = append(
-		os.Environ(),
+		e.Env,
 		fmt.Sprintf("PORT=%d", i.Port),
 		fmt.Sprintf("MAXPORT=%d", i.Port+mesh.PortRange),
 		fmt.Sprintf("LOCAL_CONTROL_URL=%s", controlUrl),
 		fmt.Sprintf("LOCAL_MACHINE_ID=%s", i.MachineId),
 		fmt.Sprintf("LOCAL_REGION=%s", i.Region),
+		fmt.Sprintf("FLY_PROCESS_GROUP=%s", i.Group),
+		fmt.Sprintf("FLY_APP_NAME=%s", i.App),
 	)
+	if i.Address.IsValid() {
+		e.Env = append(e.Env, fmt.Sprintf("LOCAL_ADDRESS=%s", i.Address))
+	}
+	if i.DNSAddr != "" {
+		e.Env = append(e.Env, fmt.Sprintf("LOCAL_DNS_ADDR=%s", i.DNSAddr))
+	}
+
+	stdout := &logWriter{i: i, stream: logStdout, out: os.Stdout}
+	stderr := &logWriter{i: i, stream: logStderr, out: os.Stderr}
+	e.Stdout = stdout
+	e.Stderr = stderr
+	e.WaitDelay = logWaitDelay // don't wait forever for output from orphaned children
 
-	// TODO: prefix output
-	e.Stdout = os.Stdout
-	e.Stderr = os.Stderr
+	setProcAttr(e)
 
 	err := e.Start()
 	if err != nil {
-		log.Printf("could not run instance=%+v, err=%v", i, err)
+		log.Printf("could not run machine=%s command=%v, err=%v", i.MachineId, command, err)
+		return fail(err)
 	}
 	log.Printf("machine=%s running (region=%s, port=%d)", i.MachineId, i.Region, i.Port)
+	i.process = e.Process
+
+	exited := make(chan struct{})
+	ready := make(chan struct{})
+	i.exitedCh = exited
+	i.readyCh = ready
+	go i.waitReady(ready, exited)
+
+	i.checks = nil
+	for _, c := range i.Checks {
+		cs := &checkState{check: c}
+		i.checks = append(i.checks, cs)
+		go cs.run(i.Host(), i.Port, i.startedAt, ready, exited)
+	}
 
 	go func() {
 		err := e.Wait()
-		if exitErr, ok := err.(*exec.ExitError); ok || err == nil {
-			closeCh <- exitErr
+		close(exited)
+
+		// tear down anything left in the process group, e.g., children of "go run"
+		signalGroup(e.Process, syscall.SIGKILL)
+		stdout.Flush()
+		stderr.Flush()
+
+		if errors.Is(err, exec.ErrWaitDelay) {
+			err = nil
+			if !e.ProcessState.Success() {
+				err = &exec.ExitError{ProcessState: e.ProcessState}
+			}
+		}
+
+		if _, ok := err.(*exec.ExitError); ok || err == nil {
+			closeCh <- err
 		} else {
 			log.Fatalf("unhandled err from exec: %v", err)
 		}
@@ -79,76 +255,427 @@ func (i *Instance) MatchRegion(region string) bool {
 	return region == "" || i.Region == region
 }
 
+// EnsureRun starts this instance if it's not running or failed. Returns true if it was started.
 func (i *Instance) EnsureRun() bool {
+	i.lock.RLock()
+	stopped := i.runCh == nil && !i.failed && !i.destroyed
+	i.lock.RUnlock()
+	if !stopped {
+		return false
+	}
+	command, err := i.command()
+
 	i.lock.Lock()
 	defer i.lock.Unlock()
-	if i.runCh != nil {
+	if i.runCh != nil || i.failed || i.destroyed {
 		return false
 	}
 
-	i.runCh = i.run()
+	i.releasePorts()
+	i.restarts = 0
+	i.doneCh = make(chan struct{})
+	i.stopCh = make(chan struct{})
+	i.runCh = i.run(command, err)
+	go i.supervise(i.runCh)
 
-	var listenForDone func(ch <-chan *exec.ExitError)
-	listenForDone = func(ch <-chan *exec.ExitError) {
+	return true
+}
+
+// supervise waits for the process to exit, restarting it according to the restart policy.
+func (i *Instance) supervise(ch <-chan error) {
+	for {
 		err := <-ch
-		var exitCode int
-		if err != nil {
-			exitCode = err.ExitCode()
+
+		exitCode := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
 		}
 		log.Printf("machine=%s stopped: %d", i.MachineId, exitCode)
 
 		i.lock.Lock()
-		defer i.lock.Unlock()
-
 		if i.runCh != ch {
 			panic("bad ch on run end")
 		}
+		i.process = nil
+		i.exitCode = exitCode
+
+		startErr, _ := err.(*startError)
+		delay, restart := i.shouldRestart(exitCode, startErr)
+		if !restart {
+			i.finish()
+			i.lock.Unlock()
+			return
+		}
+		stopCh := i.stopCh
+		i.lock.Unlock()
+
+		if delay > 0 {
+			log.Printf("machine=%s restarting in %v (restart %d)", i.MachineId, delay, i.restarts)
+			select {
+			case <-time.After(delay):
+			case <-stopCh:
+			}
+		}
 
-		if exitCode != 0 {
-			// restart, non-zero exit (can't call EnsureRun, already under lock)
-			i.runCh = i.run()
-			go listenForDone(i.runCh)
-		} else {
-			i.runCh = nil
+		command, err := i.command()
+		i.lock.Lock()
+		if i.stopping {
+			i.finish()
+			i.lock.Unlock()
+			return
+		}
+		ch = i.run(command, err)
+		i.runCh = ch
+		i.lock.Unlock()
+	}
+}
+
+// shouldRestart decides whether to restart after an exit, and after what delay. Must be under lock.
+func (i *Instance) shouldRestart(exitCode int, startErr *startError) (time.Duration, bool) {
+	if i.stopping {
+		return 0, false
+	}
+	if startErr != nil {
+		if _, ok := startErr.err.(*BuildError); ok {
+			return 0, false // not failed, the router reports this until the sources change
+		}
+		log.Printf("machine=%s failed: could not start", i.MachineId)
+		i.failed = true
+		return 0, false
+	}
+
+	if time.Since(i.startedAt) >= restartStableAfter {
+		i.restarts = 0
+	}
+
+	switch i.Restart.Policy {
+	case RestartNo:
+		return 0, false
+	case RestartAlways:
+	default:
+		if exitCode == 0 {
+			return 0, false
+		}
+		if i.restarts >= i.Restart.MaxRetries {
+			log.Printf("machine=%s failed: exited %d times", i.MachineId, i.restarts+1)
+			i.failed = true
+			return 0, false
 		}
 	}
 
-	go listenForDone(i.runCh)
+	delay := restartBackoff(i.restarts)
+	i.restarts++
+	return delay, true
+}
+
+// finish marks this instance as no longer running. Must be under lock.
+func (i *Instance) finish() {
+	i.runCh = nil
+	i.process = nil
+	i.stopping = false
+	close(i.doneCh)
+	go i.holdPorts()
+}
+
+// Stop sends sig to this instance, and kills it if it has not exited after timeout.
+// It won't be restarted regardless of its exit code. Returns false if it was not running.
+func (i *Instance) Stop(sig os.Signal, timeout time.Duration) bool {
+	i.lock.Lock()
+	if i.runCh == nil {
+		i.lock.Unlock()
+		return false
+	}
+	process := i.process
+	done := i.doneCh
+	alreadyStopping := i.stopping
+	if !alreadyStopping {
+		i.stopping = true
+		close(i.stopCh)
+	}
+	i.lock.Unlock()
+
+	if process == nil || alreadyStopping {
+		<-done // between restarts or stopped elsewhere
+		return true
+	}
+
+	log.Printf("machine=%s stopping (signal=%v)", i.MachineId, sig)
+	signalGroup(process, sig)
 
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("machine=%s did not stop after %v, killing", i.MachineId, timeout)
+		signalGroup(process, syscall.SIGKILL)
+		<-done
+	}
 	return true
 }
 
+// Destroy stops this instance and prevents it from being started again.
+func (i *Instance) Destroy(sig os.Signal, timeout time.Duration) {
+	i.lock.Lock()
+	i.destroyed = true
+	i.releasePorts()
+	i.lock.Unlock()
+	i.Stop(sig, timeout)
+}
+
+// MachineState returns the Fly Machines API state of this instance.
+// Failed instances are "stopped", and "created" ones have never been started.
+func (i *Instance) MachineState() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	switch {
+	case i.destroyed && i.runCh == nil:
+		return "destroyed"
+	case i.destroyed:
+		return "destroying"
+	case i.runCh == nil && i.startedAt.IsZero():
+		return "created"
+	case i.runCh == nil:
+		return "stopped"
+	case i.stopping:
+		return "stopping"
+	case !i.isReady():
+		return "starting"
+	}
+	return "started"
+}
+
+// Reset clears a failed instance so that it can be started again. Returns true if it was failed.
+func (i *Instance) Reset() bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	wasFailed := i.failed
+	i.failed = false
+	return wasFailed
+}
+
+// IsAlive returns whether this instance is running and not being stopped or drained.
 func (i *Instance) IsAlive() bool {
 	i.lock.RLock()
 	defer i.lock.RUnlock()
-	return i.runCh != nil
+	return i.runCh != nil && !i.stopping && !i.draining
+}
+
+// SetDraining takes this instance in or out of routing.
+func (i *Instance) SetDraining(draining bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.draining = draining
+}
+
+// Drain takes this instance out of routing and waits up to timeout for its requests to finish.
+func (i *Instance) Drain(timeout time.Duration) {
+	i.SetDraining(true)
+	deadline := time.Now().Add(timeout)
+	for i.Requests() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// IsDraining returns whether this instance has been taken out of routing.
+func (i *Instance) IsDraining() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.draining
+}
+
+// waitReady closes ready once the port accepts connections (or ReadyPath returns 2xx), unless exited first.
+func (i *Instance) waitReady(ready chan<- struct{}, exited <-chan struct{}) {
+	check := Check{Type: "tcp", Timeout: readyPollInterval * 4}
+	if i.ReadyPath != "" {
+		check = Check{Type: "http", Method: http.MethodGet, Path: i.ReadyPath, Timeout: readyPollInterval * 4}
+	}
+
+	for {
+		if check.do(i.Host(), i.Port) == nil {
+			close(ready)
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// IsReady returns whether the current process is ready to serve requests.
+func (i *Instance) IsReady() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.isReady()
+}
+
+func (i *Instance) isReady() bool {
+	if i.process == nil {
+		return false
+	}
+	select {
+	case <-i.readyCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsStarting returns whether this instance is running but not yet ready.
+func (i *Instance) IsStarting() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.runCh != nil && !i.stopping && !i.isReady()
+}
+
+// WaitReady waits until this instance is ready, across restarts, or until the timeout passes.
+// Returns false immediately if the instance is stopped.
+func (i *Instance) WaitReady(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		i.lock.RLock()
+		running := i.runCh != nil && !i.stopping
+		ready, exited := i.readyCh, i.exitedCh
+		hasProcess := i.process != nil
+		i.lock.RUnlock()
+
+		if !running {
+			return false
+		} else if !hasProcess {
+			ready, exited = nil, nil // between restarts, poll below
+		}
+
+		select {
+		case <-ready:
+			return true
+		case <-exited:
+		case <-deadline:
+			return false
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// IsFailed returns whether this instance exceeded its restart policy and won't be started.
+func (i *Instance) IsFailed() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.failed
+}
+
+// Health returns the aggregate status of this instance's checks. Running instances without checks are passing.
+func (i *Instance) Health() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.health(i.checkStatus())
+}
+
+func (i *Instance) health(checks []CheckStatus) string {
+	if i.process == nil {
+		return CheckCritical
+	}
+	return worstStatus(checks)
+}
+
+func (i *Instance) checkStatus() []CheckStatus {
+	var out []CheckStatus
+	for _, cs := range i.checks {
+		out = append(out, cs.Status())
+	}
+	return out
+}
+
+// Status describes this instance for the control endpoints.
+func (i *Instance) Status() InstanceStatus {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	state := "started"
+	switch {
+	case i.failed:
+		state = "failed"
+	case i.runCh == nil:
+		state = "stopped"
+	case i.stopping:
+		state = "stopping"
+	case i.draining:
+		state = "draining"
+	case i.process == nil:
+		state = "restarting"
+	}
+
+	checks := i.checkStatus()
+	return InstanceStatus{
+		Machine:     i.MachineId,
+		Region:      i.Region,
+		Group:       i.Group,
+		Port:        i.Port,
+		State:       state,
+		Health:      i.health(checks),
+		Ready:       i.isReady(),
+		Checks:      checks,
+		Requests:    i.Requests(),
+		Connections: i.Connections(),
+		Wakeups:     i.wakeups.Load(),
+		Restarts:    i.restarts,
+		ExitCode:    i.exitCode,
+	}
+}
+
+type InstanceStatus struct {
+	Machine     string        `json:"machine"`
+	Region      string        `json:"region"`
+	Group       string        `json:"group"`
+	Port        uint16        `json:"port"`
+	State       string        `json:"state"`
+	Health      string        `json:"health"`
+	Ready       bool          `json:"ready"`
+	Checks      []CheckStatus `json:"checks,omitempty"`
+	Requests    int           `json:"requests"`
+	Connections int           `json:"connections"`
+	Wakeups     int64         `json:"wakeups"`
+	Restarts    int           `json:"restarts"`
+	ExitCode    int           `json:"exitCode"`
 }
 
 type ErrReplay struct {
-	Replay string
+	Replay   string
+	Cache    string // fly-replay-cache pattern, if any
+	CacheTTL string
 }
 
 func (e *ErrReplay) Error() string {
 	return fmt.Sprintf("replay: %v", e.Replay)
 }
 
-func (i *Instance) SendTo(replay func(i *Instance, replay string), w http.ResponseWriter, r *http.Request) bool {
+// SendTo proxies the request to this instance, which must have been acquired. Returns false if it refused the connection.
+// The request and the response are each delayed by latency, as if they had crossed regions.
+// The request is released before any replay, so it doesn't hold this instance while waiting on the target.
+func (i *Instance) SendTo(replay func(i *Instance, re *ErrReplay), latency time.Duration, w http.ResponseWriter, r *http.Request) bool {
 	var isRefused bool
-	i.active.Add(+1)
-	defer i.active.Add(-1)
+	var replayErr *ErrReplay
 
 	rp := httputil.ReverseProxy{
+		Transport: i.getTransport(),
 		Director: func(r *http.Request) {
-			r.Host = fmt.Sprintf("localhost:%d", i.Port)
+			r.Host = i.HostPort(0)
 			r.URL.Host = r.Host
 			r.URL.Scheme = "http"
 		},
 
 		ModifyResponse: func(r *http.Response) error {
+			if err := sleepContext(r.Request.Context(), latency); err != nil {
+				return err
+			}
+
 			replay := r.Header.Get(headerReplay)
 			if replay != "" {
-				// TODO: we support region replay, actual Fly supports a lot more
-				return &ErrReplay{Replay: replay}
+				return &ErrReplay{
+					Replay:   replay,
+					Cache:    r.Header.Get(headerReplayCache),
+					CacheTTL: r.Header.Get(headerReplayCacheTTL),
+				}
 			}
 
 			return nil
@@ -156,23 +683,65 @@ func (i *Instance) SendTo(replay func(i *Instance, replay string), w http.Respon
 
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			if re, ok := err.(*ErrReplay); ok {
-				// http.Error(w, "replay:"+replay.Replay, http.StatusTeapot)
-				replay(i, re.Replay)
+				replayErr = re
 				return
 			}
 
 			isRefused = errors.Is(err, syscall.ECONNREFUSED)
-			if !isRefused {
+			if !isRefused && !errors.Is(err, context.Canceled) {
 				log.Printf("got gatway err: %+v", err)
 				http.Error(w, "", http.StatusBadGateway)
 			}
 		},
 	}
+	if sleepContext(r.Context(), latency) != nil {
+		i.release()
+		return true // client went away
+	}
 	rp.ServeHTTP(w, r)
+	i.release()
 
+	if replayErr != nil {
+		replay(i, replayErr)
+	}
 	return !isRefused
 }
 
+// getTransport returns the transport to this instance, which counts its connections.
+// With ConnPerRequest, connections aren't kept alive, so each request in flight holds exactly one.
+func (i *Instance) getTransport() *http.Transport {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.transport != nil {
+		return i.transport
+	}
+
+	i.transport = http.DefaultTransport.(*http.Transport).Clone()
+	i.transport.DisableKeepAlives = i.ConnPerRequest
+	dial := i.transport.DialContext
+	i.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		i.conns.Add(+1)
+		return &countedConn{Conn: conn, count: &i.conns}, nil
+	}
+	return i.transport
+}
+
+// countedConn decrements count when closed.
+type countedConn struct {
+	net.Conn
+	once  sync.Once
+	count *atomic.Int32
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.count.Add(-1) })
+	return c.Conn.Close()
+}
+
 func (i *Instance) Less(other *Instance) bool {
 	active := i.Active()
 	otherActive := other.Active()
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	i := &Instance{}
+
+	var wg sync.WaitGroup
+	var acquired atomic.Int32
+	for n := 0; n < 100; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i.acquire(2) {
+				acquired.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := acquired.Load(); got != 2 {
+		t.Fatalf("acquired %d requests with limit=2", got)
+	}
+	if i.acquire(2) {
+		t.Errorf("acquired over limit=2")
+	}
+
+	i.release()
+	if !i.acquire(2) {
+		t.Errorf("can't acquire after release")
+	}
+	if !i.acquire(0) || i.Requests() != 3 {
+		t.Errorf("limit=0 should always acquire, got requests=%d", i.Requests())
+	}
+}
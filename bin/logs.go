@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	logStdout = "stdout"
+	logStderr = "stderr"
+)
+
+var (
+	logColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+	useColor  = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+)
+
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Machine string    `json:"machine"`
+	Region  string    `json:"region"`
+	Stream  string    `json:"stream"` // "stdout" or "stderr"
+	Text    string    `json:"text"`
+}
+
+// String formats this line for a plain text log stream.
+func (l LogLine) String() string {
+	return fmt.Sprintf("%s %s %s %s: %s", l.Time.UTC().Format(time.RFC3339Nano), l.Machine, l.Region, l.Stream, l.Text)
+}
+
+// LogBuffer keeps the last Size lines of a machine's output, and streams new lines to followers.
+type LogBuffer struct {
+	Size int
+
+	lock      sync.Mutex
+	lines     []LogLine
+	next      int // next index to write once lines is full
+	followers map[chan LogLine]bool
+}
+
+func (lb *LogBuffer) add(line LogLine) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+
+	if len(lb.lines) < lb.Size {
+		lb.lines = append(lb.lines, line)
+	} else if lb.Size > 0 {
+		lb.lines[lb.next] = line
+		lb.next = (lb.next + 1) % lb.Size
+	}
+
+	for ch := range lb.followers {
+		select {
+		case ch <- line:
+		default: // follower is too slow, drop
+		}
+	}
+}
+
+// Lines returns the buffered lines, oldest first.
+func (lb *LogBuffer) Lines() []LogLine {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	out := make([]LogLine, 0, len(lb.lines))
+	out = append(out, lb.lines[lb.next:]...)
+	return append(out, lb.lines[:lb.next]...)
+}
+
+// Follow returns a channel of new lines, and a func to stop following.
+func (lb *LogBuffer) Follow() (<-chan LogLine, func()) {
+	ch := make(chan LogLine, 256)
+
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	if lb.followers == nil {
+		lb.followers = make(map[chan LogLine]bool)
+	}
+	lb.followers[ch] = true
+
+	return ch, func() {
+		lb.lock.Lock()
+		defer lb.lock.Unlock()
+		if lb.followers[ch] {
+			delete(lb.followers, ch)
+			close(ch)
+		}
+	}
+}
+
+// logWriter splits a machine's output into lines, buffering them and writing them prefixed to out.
+type logWriter struct {
+	i       *Instance
+	stream  string
+	out     io.Writer
+	partial []byte
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+	lw.partial = append(lw.partial, b...)
+	for {
+		index := bytes.IndexByte(lw.partial, '\n')
+		if index == -1 {
+			break
+		}
+		lw.writeLine(string(bytes.TrimRight(lw.partial[:index], "\r")))
+		lw.partial = lw.partial[index+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes any partial line, e.g., when the process exits.
+func (lw *logWriter) Flush() {
+	if len(lw.partial) > 0 {
+		lw.writeLine(string(lw.partial))
+		lw.partial = nil
+	}
+}
+
+func (lw *logWriter) writeLine(text string) {
+	lw.i.Logs.add(LogLine{
+		Time:    time.Now(),
+		Machine: lw.i.MachineId,
+		Region:  lw.i.Region,
+		Stream:  lw.stream,
+		Text:    text,
+	})
+
+	prefix := fmt.Sprintf("[%s %s]", lw.i.MachineId, lw.i.Region)
+	if useColor {
+		h := fnv.New32a()
+		h.Write([]byte(lw.i.MachineId))
+		color := logColors[h.Sum32()%uint32(len(logColors))]
+		prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, prefix)
+	}
+	fmt.Fprintf(lw.out, "%s %s\n", prefix, text)
+}
+
+// handleSpecialLogs writes the logs of one or all machines as text or NDJSON, optionally following new lines.
+func handleSpecialLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	machine := q.Get("machine")
+	follow := q.Get("follow") == "1" || q.Get("follow") == "true"
+	ndjson := q.Get("format") == "ndjson" || r.Header.Get("Accept") == "application/x-ndjson"
+
+	var buffers []*LogBuffer
+	for _, i := range cluster.Instances() {
+		if machine == "" || i.MachineId == machine {
+			buffers = append(buffers, i.Logs)
+		}
+	}
+	if len(buffers) == 0 {
+		http.Error(w, fmt.Sprintf("unknown machine=%s", machine), http.StatusNotFound)
+		return
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	enc := json.NewEncoder(w)
+	write := func(line LogLine) {
+		if ndjson {
+			enc.Encode(line)
+		} else {
+			fmt.Fprintln(w, line.String())
+		}
+	}
+
+	// subscribe before reading the backlog, so nothing is missed
+	all := make(chan LogLine, 256)
+	if follow {
+		for _, lb := range buffers {
+			ch, stop := lb.Follow()
+			defer stop()
+			go func() {
+				for line := range ch {
+					select {
+					case all <- line:
+					case <-r.Context().Done():
+					}
+				}
+			}()
+		}
+	}
+
+	var backlog []LogLine
+	for _, lb := range buffers {
+		backlog = append(backlog, lb.Lines()...)
+	}
+	sort.SliceStable(backlog, func(a, b int) bool { return backlog[a].Time.Before(backlog[b].Time) })
+	var last time.Time
+	for _, line := range backlog {
+		write(line)
+		last = line.Time
+	}
+	if !follow {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case line := <-all:
+			if !line.Time.After(last) {
+				continue // already sent in backlog
+			}
+			write(line)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	machinesAPIBase     = "/__" // like "https://api.machines.dev", so apps keep every other path
+	machinesWaitDefault = time.Minute
+	machinesWaitMax     = time.Minute
+)
+
+// Machine is a machine as returned by the Fly Machines API.
+type Machine struct {
+	Id        string        `json:"id"`
+	Name      string        `json:"name"`
+	State     string        `json:"state"`
+	Region    string        `json:"region"`
+	PrivateIP string        `json:"private_ip"`
+	Config    MachineConfig `json:"config"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+type MachineConfig struct {
+	Env      map[string]string `json:"env,omitempty"`
+	Init     MachineInit       `json:"init"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type MachineInit struct {
+	Cmd []string `json:"cmd,omitempty"`
+}
+
+// machinesError is returned as {"error": "..."} with the given status code, like Fly.
+type machinesError struct {
+	status int
+	msg    string
+}
+
+func (e *machinesError) Error() string {
+	return e.msg
+}
+
+func machineFor(i *Instance) Machine {
+	env := make(map[string]string)
+	for _, kv := range i.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		env[key] = value
+	}
+
+	cmd := i.Command
+	if i.Build != nil {
+		cmd = i.Args
+	}
+
+	return Machine{
+		Id:        i.MachineId,
+		Name:      i.MachineId,
+		State:     i.MachineState(),
+		Region:    i.Region,
+		PrivateIP: i.PrivateAddr().String(),
+		Config: MachineConfig{
+			Env:      env,
+			Init:     MachineInit{Cmd: cmd},
+			Metadata: map[string]string{"fly_process_group": i.Group},
+		},
+		CreatedAt: i.Created,
+	}
+}
+
+// handleMachinesAPI serves a subset of the Fly Machines API under "/__/v1/apps/<app>/machines".
+func handleMachinesAPI(w http.ResponseWriter, r *http.Request) {
+	// e.g., ["v1", "apps", "<app>", "machines", "<id>", "wait"]
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, machinesAPIBase), "/"), "/")
+
+	var out interface{}
+	if len(parts) < 4 || parts[3] != "machines" {
+		out = &machinesError{http.StatusNotFound, "not found"}
+	} else if app := parts[2]; !cluster.HasApp(app) {
+		out = &machinesError{http.StatusNotFound, fmt.Sprintf("app not found: %s", app)}
+	} else if len(parts) == 4 {
+		switch r.Method {
+		case http.MethodGet:
+			out = handleMachinesList(app)
+		case http.MethodPost:
+			out = handleMachinesCreate(r, app)
+		default:
+			out = &machinesError{http.StatusMethodNotAllowed, "method not allowed"}
+		}
+	} else if i := cluster.Lookup(parts[4]); i == nil || i.App != parts[2] {
+		out = &machinesError{http.StatusNotFound, "machine not found"}
+	} else {
+		action := strings.Join(parts[5:], "/")
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			out = machineFor(i)
+		case action == "" && r.Method == http.MethodDelete:
+			out = handleMachinesDestroy(r, i)
+		case action == "start" && r.Method == http.MethodPost:
+			out = handleMachinesStart(i)
+		case action == "stop" && r.Method == http.MethodPost:
+			out = handleMachinesStop(r, i)
+		case action == "wait" && r.Method == http.MethodGet:
+			out = handleMachinesWait(r, i)
+		default:
+			out = &machinesError{http.StatusNotFound, "not found"}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err, ok := out.(*machinesError); ok {
+		w.WriteHeader(err.status)
+		out = map[string]string{"error": err.msg}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func handleMachinesList(app string) interface{} {
+	out := []Machine{}
+	for _, i := range cluster.Instances() {
+		if i.App == app {
+			out = append(out, machineFor(i))
+		}
+	}
+	return out
+}
+
+// handleMachinesCreate creates a machine like one of the process groups, selected by its metadata.
+func handleMachinesCreate(r *http.Request, app string) interface{} {
+	var req struct {
+		Region     string        `json:"region"`
+		Config     MachineConfig `json:"config"`
+		SkipLaunch bool          `json:"skip_launch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &machinesError{http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err)}
+	}
+
+	groupName := req.Config.Metadata["fly_process_group"]
+	if groupName == "" {
+		groupName = defaultGroup
+	}
+	template := cluster.Group(app, groupName)
+	if template == nil {
+		return &machinesError{http.StatusBadRequest, fmt.Sprintf("unknown process group: %s", groupName)}
+	}
+
+	region := template.Regions[0]
+	if req.Region != "" {
+		regions, err := parseRegions(req.Region)
+		if err != nil || len(regions) != 1 {
+			return &machinesError{http.StatusBadRequest, fmt.Sprintf("invalid region: %s", req.Region)}
+		}
+		region = regions[0]
+	}
+
+	// a copy of the group with this machine's config
+	g := *template
+	g.Env = append([]string(nil), template.Env...)
+	for key, value := range req.Config.Env {
+		g.Env = append(g.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	if len(req.Config.Init.Cmd) != 0 {
+		if g.Build != nil {
+			g.Args = req.Config.Init.Cmd
+		} else {
+			g.Command = req.Config.Init.Cmd
+		}
+	}
+
+	i, err := cluster.Add(&g, region)
+	if err != nil {
+		return &machinesError{http.StatusUnprocessableEntity, err.Error()}
+	}
+	if !req.SkipLaunch {
+		i.EnsureRun()
+	}
+	return machineFor(i)
+}
+
+func handleMachinesStart(i *Instance) interface{} {
+	previous := i.MachineState()
+	if previous == "destroyed" || previous == "destroying" {
+		return &machinesError{http.StatusPreconditionFailed, fmt.Sprintf("machine is %s", previous)}
+	}
+	i.Reset()
+	i.EnsureRun()
+	return map[string]interface{}{"previous_state": previous}
+}
+
+// handleMachinesStop stops a machine in the background, with an optional signal and timeout.
+func handleMachinesStop(r *http.Request, i *Instance) interface{} {
+	var req struct {
+		Signal  string      `json:"signal"`
+		Timeout interface{} `json:"timeout"` // a duration like "10s", or seconds
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return &machinesError{http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err)}
+		}
+	}
+
+	sig, timeout, err := machinesStopConfig(req.Signal, req.Timeout)
+	if err != nil {
+		return &machinesError{http.StatusBadRequest, err.Error()}
+	}
+	go i.Stop(sig, timeout)
+	return map[string]interface{}{"ok": true}
+}
+
+// machinesStopConfig returns the signal and timeout to stop a machine with, using the flags as defaults.
+func machinesStopConfig(rawSignal string, rawTimeout interface{}) (os.Signal, time.Duration, error) {
+	if rawSignal == "" {
+		rawSignal = *flagKillSignal
+	}
+	sig, err := parseSignal(rawSignal)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := *flagKillTimeout
+	switch t := rawTimeout.(type) {
+	case float64:
+		timeout = time.Duration(t * float64(time.Second))
+	case string:
+		timeout, err = time.ParseDuration(t)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid timeout: %q", t)
+		}
+	}
+	return sig, timeout, nil
+}
+
+// handleMachinesDestroy destroys a stopped machine, or any machine with force=true.
+func handleMachinesDestroy(r *http.Request, i *Instance) interface{} {
+	state := i.MachineState()
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	switch state {
+	case "destroyed", "destroying":
+		return &machinesError{http.StatusPreconditionFailed, fmt.Sprintf("machine is already %s", state)}
+	case "created", "stopped":
+	default:
+		if !force {
+			return &machinesError{http.StatusPreconditionFailed, fmt.Sprintf("failed_precondition: machine is %s, stop it first or use force=true", state)}
+		}
+	}
+
+	sig, timeout, _ := machinesStopConfig("", nil)
+	if force {
+		sig = syscall.SIGKILL
+	}
+	log.Printf("destroying machine=%s (state=%s)", i.MachineId, state)
+	cluster.Destroy(i, sig, timeout)
+	return map[string]interface{}{"ok": true}
+}
+
+// handleMachinesWait waits for a machine to reach ?state= (default "started"), for up to ?timeout= seconds.
+func handleMachinesWait(r *http.Request, i *Instance) interface{} {
+	q := r.URL.Query()
+	state := q.Get("state")
+	if state == "" {
+		state = "started"
+	}
+	switch state {
+	case "started", "stopped", "destroyed":
+	default:
+		return &machinesError{http.StatusBadRequest, fmt.Sprintf("invalid state: %q", state)}
+	}
+
+	timeout := machinesWaitDefault
+	if raw := q.Get("timeout"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return &machinesError{http.StatusBadRequest, fmt.Sprintf("invalid timeout: %q", raw)}
+		}
+		timeout = min(time.Duration(seconds)*time.Second, machinesWaitMax)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		current := i.MachineState()
+		if current == state || (state == "stopped" && current == "created") {
+			return map[string]interface{}{"ok": true}
+		}
+		select {
+		case <-deadline:
+			return &machinesError{http.StatusRequestTimeout, fmt.Sprintf("deadline_exceeded: machine is %s, waited %v for %s", current, timeout, state)}
+		case <-r.Context().Done():
+			return nil
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
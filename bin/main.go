@@ -1,115 +1,427 @@
 // Provides a local daemon for running things like Fly.io servers locally.
-// Assumes that the package under control stops after some time (does not kill it).
+// Runs either a Go package or an arbitrary command per machine.
+// Stops idle machines after -idle, otherwise assumes that the program under control stops itself.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	mesh "github.com/samthor/hangar/lib"
 )
 
-const (
-	healthyTimeout = time.Second * 4
-	healthyRetries = 12
-)
-
 var (
 	flagPort         = flag.Uint("port", 8080, "the forward-facing web address")
 	flagAllowNetwork = flag.Bool("a", false, "whether to allow remote access")
 
-	flagCount       = flag.Int("c", 4, "number of instances to run")
-	flagPackage     = flag.String("p", "", "go package to run")
-	flagRegion      = flag.String("r", "syd,ord,ams", "round-robin around these virtual regions")
-	flagSeed        = flag.Int64("seed", 1, "seed for random machine IDs")
-	flagStart       = flag.Bool("s", false, "whether to start servers without requests")
-	flagActive      = flag.Int("load", 2, "if handling >requests, try another machine")
-	flagReplayCount = flag.Int("replay", 4, "number of times a request can be replayed")
+	flagConfig           = flag.String("config", "", "fly.toml to configure the cluster from, flags override it")
+	flagApp              = flag.String("app", "hangar", "the app name, as FLY_APP_NAME")
+	flagCount            = flag.Int("c", 4, "number of instances to run (per process group)")
+	flagPackage          = flag.String("p", "", "go package to run")
+	flagCommand          = flag.String("cmd", "", "command to run instead of a go package, split on spaces (or pass after --)")
+	flagBuildCache       = flag.String("build-cache", "", "directory to cache built packages in (default user cache dir)")
+	flagTags             = flag.String("tags", "", "build tags for the go package")
+	flagRace             = flag.Bool("race", false, "build the go package with the race detector")
+	flagLdflags          = flag.String("ldflags", "", "ldflags for the go package")
+	flagRegion           = flag.String("r", "syd,ord,ams", "round-robin around these virtual regions")
+	flagSeed             = flag.Int64("seed", 1, "seed for random machine IDs")
+	flagStart            = flag.Bool("s", false, "whether to start servers without requests")
+	flagAutoStart        = flag.Bool("auto-start", true, "whether requests or load start stopped machines, like auto_start_machines")
+	flagSocketActivation = flag.Bool("socket-activation", true, "hold stopped machines' ports, starting them when a connection arrives")
+	flagMinRunning       = flag.Int("min-running", 0, "machines to keep running in the first region, like min_machines_running")
+	flagStartTimeout     = flag.Duration("start-timeout", time.Second*10, "how long requests wait for a starting machine to be ready")
+	flagReadyPath        = flag.String("ready-path", "", "machines are ready once this path returns 2xx, rather than when they accept connections")
+	flagActive           = flag.Int("load", 2, "soft limit: machines at this load are skipped if possible, like soft_limit")
+	flagHardLimit        = flag.Int("hard-limit", 0, "requests queue for machines at this load, like hard_limit (0 for no limit)")
+	flagConcurrency      = flag.String("concurrency", "requests", "how load is measured: requests or connections")
+	flagQueueTimeout     = flag.Duration("queue-timeout", time.Second*5, "how long requests queue for machines at their hard limit before a 503")
+	flagReplayCount      = flag.Int("replay", 4, "number of times a request can be replayed")
+	flagReplayBody       = flag.Int64("replay-body", 1<<20, "request bodies up to this many bytes are buffered so they can be replayed")
+	flagLatency          = flag.Bool("latency", true, "delay requests and responses by the virtual latency between the client's region and the machine's")
+	flagClientRegion     = flag.String("client-region", "", "the region requests come from (default the first region)")
+	flagPeerProxy        = flag.Bool("peer-proxy", true, "forward private traffic between machines through the daemon, with latency and partitions")
+	flagPeerPort         = flag.Uint("peer-port", 0, "the first port for peer links (default leaves room for 64 machines)")
+	flagJitter           = flag.Duration("jitter", 0, "random extra latency for peer traffic, up to this")
+	flagDrop             = flag.Float64("drop", 0, "rate of dropped peer connections and packets (0-1), packets are delayed as if retransmitted")
+	flagPrivateIP        = flag.String("private-ip", "", "give each machine its own loopback address and $PORT=8080, like on Fly: v4 (in 127.0.0.0/8) or v6 (added to lo, needs root)")
+	flagDNS              = flag.String("dns", "", "serve Fly's .internal names on this address (e.g., 127.0.0.1:8053), and have lib discover peers with them")
+	flagIdle             = flag.Duration("idle", 0, "stop machines with no requests for this long, like auto_stop_machines (0 to disable)")
+	flagKillSignal       = flag.String("kill-signal", "SIGINT", "signal sent to stop machines")
+	flagKillTimeout      = flag.Duration("kill-timeout", time.Second*5, "time to wait after the kill signal before SIGKILL")
+	flagRestart          = flag.String("restart", RestartOnFailure, "restart policy for machines: always, on-failure or no")
+	flagMaxRetries       = flag.Int("max-retries", 10, "restarts before an on-failure machine is marked as failed")
+	flagLogLines         = flag.Int("log-lines", 1000, "lines of output to keep per machine for /__/logs")
+	flagWatch            = flag.Bool("w", false, "watch the go package's module, rebuilding and doing a rolling restart on change")
 
 	flagAliveOnly = flag.Bool("alive-only", false, "whether to only report live instances via the faux-discover endpoint: it's unclear what Fly.io's intended behavior is :thinking_face:")
 )
 
 var (
-	allInstances []*Instance
+	flagChecks checkFlag
+	flagGroups groupFlag
+)
+
+func init() {
+	flag.Var(&flagChecks, "check", `health check like "type=http;path=/healthz;interval=10s;timeout=2s;grace_period=5s" (repeatable)`)
+	flag.Var(&flagGroups, "group", `extra process group like "name=worker;cmd=node worker.js;count=2;regions=syd,ams;http=false", or with package=<go package> (repeatable)`)
+}
+
+var (
+	cluster      *Cluster
+	shuttingDown = make(chan struct{}) // closed when the daemon is shutting down
 )
 
 func main() {
 	flag.Parse()
-	if *flagPackage == "" {
-		log.Fatalf("need -p <package> to run")
+
+	var cfg *flyConfig
+	if *flagConfig != "" {
+		var err error
+		cfg, err = loadFlyConfig(*flagConfig)
+		if err != nil {
+			log.Fatalf("could not load config: %v", err)
+		}
+		cfg.applyFlags()
 	}
 
-	regions := strings.Split(strings.ToLower(*flagRegion), ",")
-	if len(regions) == 0 {
-		log.Fatalf("need comma-separated regions: had %v", regions)
+	killSignal, err := parseSignal(*flagKillSignal)
+	if err != nil {
+		log.Fatalf("bad -kill-signal: %v", err)
 	}
-	for i, r := range regions {
-		r = strings.ToLower(strings.TrimSpace(r))
-		regions[i] = r
-		if len(r) != 3 {
-			log.Fatalf("regions must be 3-character codes, had %v", regions)
-		}
+
+	restart, err := parseRestartPolicy(*flagRestart, *flagMaxRetries)
+	if err != nil {
+		log.Fatalf("bad -restart: %v", err)
+	}
+
+	regions, err := parseRegions(*flagRegion)
+	if err != nil {
+		log.Fatalf("bad -r: %v", err)
 	}
 	defaultRegion := regions[0]
 	log.Printf("choosing default region=%s from regions=%v", defaultRegion, regions)
 
+	groups := groupsFromFlags(cfg)
+
+	names := make(map[[2]string]bool)
+	builds := make(map[string]*Build) // by package, as groups share build flags
+	total := 0
+	for _, g := range groups {
+		if names[[2]string{g.App, g.Name}] {
+			log.Fatalf("duplicate process group: %s (app=%s)", g.Name, g.App)
+		}
+		names[[2]string{g.App, g.Name}] = true
+		total += g.Count
+
+		if g.Regions == nil {
+			g.Regions = regions
+		}
+		if g.Package != "" && builds[g.Package] != nil {
+			g.Build = builds[g.Package]
+		} else if g.Package != "" {
+			g.Build = buildFromFlags(g.Package)
+			builds[g.Package] = g.Build
+			if _, err := g.Build.Binary(); err != nil {
+				log.Printf("%v, serving errors until it's fixed", err)
+			}
+		}
+
+		g.Restart = restart
+		g.Checks = flagChecks
+		if cfg != nil {
+			g.Env = cfg.env()
+			g.Mounts = cfg.mountsFor(g.Name)
+			if len(g.Checks) == 0 {
+				g.Checks, err = cfg.checks(g.HTTP)
+				if err != nil {
+					log.Fatalf("fly.toml: %v", err)
+				}
+			}
+		}
+	}
+
+	var private *PrivateNet
+	switch *flagPrivateIP {
+	case "":
+	case "v4", "v6":
+		if *flagAllowNetwork && *flagPort == privatePort {
+			log.Fatalf("can't listen on all addresses with -private-ip, machines need port %d: pass another -port", privatePort)
+		}
+		private = &PrivateNet{IPv6: *flagPrivateIP == "v6"}
+	default:
+		log.Fatalf("bad -private-ip: %q", *flagPrivateIP)
+	}
+
 	portStart := *flagPort + 1
-	maxPort := portStart + (uint(*flagCount) * mesh.PortRange)
-	if maxPort >= 65536 {
-		log.Fatalf("can't run %d instances (%d ports each), max=%d", *flagCount, mesh.PortRange, maxPort)
+	limitPort := uint(65536)
+	var peers *PeerNet
+	if *flagPeerProxy {
+		peerPort := *flagPeerPort
+		if peerPort == 0 {
+			peerPort = portStart + 64*mesh.PortRange
+		}
+		peers = &PeerNet{PortStart: peerPort, Private: private, Latency: *flagLatency}
+		peers.SetImpairment(*flagJitter, *flagDrop)
+		if private == nil {
+			limitPort = peerPort
+		}
+	}
+	maxPort := portStart + (uint(total) * mesh.PortRange)
+	if private == nil && maxPort > limitPort {
+		log.Fatalf("can't run %d instances (%d ports each), max=%d", total, mesh.PortRange, maxPort)
+	}
+
+	if *flagConcurrency != "requests" && *flagConcurrency != "connections" {
+		log.Fatalf("bad -concurrency: %q", *flagConcurrency)
+	}
+	clientRegion := strings.ToLower(*flagClientRegion)
+	if clientRegion == "" {
+		clientRegion = defaultRegion
+	}
+	if !*flagLatency {
+		clientRegion = ""
 	}
 
-	r := rand.NewSource(*flagSeed)
 	router := &Router{
 		regionToInstance: make(map[string]InstanceList),
 		defaultRegion:    defaultRegion,
+		app:              *flagApp,
+		clientRegion:     clientRegion,
+		concurrency: Concurrency{
+			Type:         *flagConcurrency,
+			SoftLimit:    *flagActive,
+			HardLimit:    *flagHardLimit,
+			QueueTimeout: *flagQueueTimeout,
+		},
 	}
-
-	for i := 0; i < *flagCount; i++ {
-		port := portStart + uint(i*mesh.PortRange)
-		region := regions[i%len(regions)]
-
-		machineNo := uint64(r.Int63()) >> 31
-		machineId := fmt.Sprintf("%0x", machineNo)
-		for len(machineId) < 8 {
-			machineId = "0" + machineId
+	cluster = &Cluster{
+		Router:    router,
+		Groups:    groups,
+		PortStart: portStart,
+		MaxPort:   limitPort,
+		Peers:     peers,
+		Private:   private,
+		Rand:      rand.NewSource(*flagSeed),
+	}
+	if *flagDNS != "" {
+		var dns DNSServer
+		if err := dns.Listen(*flagDNS); err != nil {
+			log.Fatalf("can't serve DNS: %v", err)
 		}
+		cluster.DNSAddr = dns.Addr()
+		log.Printf("serving .internal DNS on %s", cluster.DNSAddr)
+	}
 
-		i := &Instance{
-			ControlPort: uint16(*flagPort),
-			Port:        uint16(port),
-			Region:      region,
-			Package:     *flagPackage,
-			MachineId:   machineId,
+	for _, g := range groups {
+		if g.HTTP && g.Build != nil && !slices.Contains(router.builds, g.Build) {
+			router.builds = append(router.builds, g.Build)
+		}
+		for n := 0; n < g.Count; n++ {
+			if _, err := cluster.Add(g, g.Regions[n%len(g.Regions)]); err != nil {
+				log.Fatalf("could not create machine: %v", err)
+			}
 		}
-		router.regionToInstance[region] = append(router.regionToInstance[region], i)
-		allInstances = append(allInstances, i)
-
-		log.Printf("generated machine=%s (region=%s port=%d)", i.MachineId, i.Region, port)
 	}
 
 	if *flagStart {
 		log.Printf("starting instances...")
-		for _, i := range allInstances {
+		for _, i := range cluster.Instances() {
 			i.EnsureRun()
 		}
 	}
 
+	if *flagWatch {
+		for _, b := range builds {
+			go watchAndRestart(b, killSignal, *flagKillTimeout)
+		}
+		if len(builds) == 0 {
+			log.Fatalf("can only watch go packages")
+		}
+	}
+
+	if *flagIdle > 0 {
+		go stopIdle(*flagIdle, killSignal, *flagKillTimeout)
+	}
+	go router.autoscale(*flagMinRunning)
+
 	var handler http.ServeMux
 	handler.HandleFunc("/__/", handleSpecial)
+	handler.HandleFunc(machinesAPIBase+"/v1/apps/", handleMachinesAPI)
 	handler.Handle("/", router)
 
 	var host string
 	if !*flagAllowNetwork {
 		host = "localhost"
 	}
-	http.ListenAndServe(fmt.Sprintf("%s:%d", host, *flagPort), &handler)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", host, *flagPort),
+		Handler: &handler,
+	}
+
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatalf("could not serve: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop() // a second signal kills us immediately
+
+	log.Printf("shutting down, draining requests...")
+	drainCtx, cancel := context.WithTimeout(context.Background(), *flagKillTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.Printf("could not drain requests: %v", err)
+	}
+
+	stopAll(killSignal, *flagKillTimeout)
+	log.Printf("all machines stopped")
+	if private != nil {
+		private.Close()
+	}
+}
+
+// stopAll stops all instances concurrently, returning once they have all exited.
+func stopAll(sig os.Signal, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, i := range cluster.Instances() {
+		wg.Add(1)
+		go func(i *Instance) {
+			defer wg.Done()
+			i.Stop(sig, timeout)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// stopIdle stops instances which have had no requests for the given timeout.
+// Routed instances in the default region aren't stopped below -min-running.
+func stopIdle(timeout time.Duration, sig os.Signal, killTimeout time.Duration) {
+	interval := min(timeout/4, time.Second)
+	for range time.Tick(interval) {
+		spare := cluster.Router.spareRunning(*flagMinRunning)
+		for _, i := range cluster.Instances() {
+			if !cluster.Group(i.App, i.Group).HTTP {
+				continue // workers get no requests, so they're never idle
+			}
+			if idle := i.IdleFor(); i.IsAlive() && idle >= timeout {
+				if i.App == *flagApp && i.Region == cluster.Router.defaultRegion {
+					if spare <= 0 {
+						continue
+					}
+					spare--
+				}
+				log.Printf("machine=%s idle for %v", i.MachineId, idle.Round(time.Second))
+				go i.Stop(sig, killTimeout)
+			}
+		}
+	}
+}
+
+// groupsFromFlags returns the process groups to run: from fly.toml's [processes], otherwise "app" from -p or -cmd.
+// Groups from -group are added, replacing any with the same name.
+func groupsFromFlags(cfg *flyConfig) []*Group {
+	var command []string
+	if *flagCommand != "" {
+		command = strings.Fields(*flagCommand)
+	} else {
+		command = flag.Args()
+	}
+	if *flagPackage != "" && len(command) != 0 {
+		log.Fatalf("can't run both -p <package> and a command: %v", command)
+	}
+
+	var groups []*Group
+	if cfg != nil && len(cfg.Processes) != 0 {
+		groups = cfg.groups(*flagPackage, *flagCount)
+		for _, g := range groups {
+			if g.Name == defaultGroup && len(command) != 0 {
+				g.Command = command
+			}
+		}
+	} else if *flagPackage != "" || len(command) != 0 {
+		http := true
+		if cfg != nil {
+			http = cfg.httpProcesses()[defaultGroup]
+		}
+		groups = append(groups, &Group{
+			Name:    defaultGroup,
+			Package: *flagPackage,
+			Command: command,
+			Count:   *flagCount,
+			HTTP:    http,
+		})
+	}
+
+	for _, g := range groups {
+		g.App = *flagApp
+	}
+	base := len(groups)
+outer:
+	for _, extra := range flagGroups {
+		if extra.App == "" {
+			extra.App = *flagApp
+		}
+		for index, g := range groups[:base] {
+			if g.App == extra.App && g.Name == extra.Name {
+				groups[index] = extra
+				continue outer
+			}
+		}
+		groups = append(groups, extra)
+	}
+
+	if len(groups) == 0 {
+		log.Fatalf("need -p <package>, -cmd <command>, a command after -- or -group to run")
+	}
+	return groups
+}
+
+// buildFromFlags returns the go package to build and run.
+func buildFromFlags(pkg string) *Build {
+	cacheDir := *flagBuildCache
+	if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("can't find cache dir, use -build-cache: %v", err)
+		}
+		cacheDir = filepath.Join(userCache, "hangar", "build")
+	}
+
+	var flags []string
+	if *flagTags != "" {
+		flags = append(flags, "-tags", *flagTags)
+	}
+	if *flagRace {
+		flags = append(flags, "-race")
+	}
+	if *flagLdflags != "" {
+		flags = append(flags, "-ldflags", *flagLdflags)
+	}
+
+	return &Build{
+		Package:  pkg,
+		Flags:    flags,
+		CacheDir: cacheDir,
+	}
 }
 
 func handleSpecial(w http.ResponseWriter, r *http.Request) {
@@ -122,6 +434,24 @@ func handleSpecial(w http.ResponseWriter, r *http.Request) {
 	case "/__/start":
 		out = handleSpecialStart(r)
 
+	case "/__/scale":
+		out = handleSpecialScale(r)
+
+	case "/__/remove":
+		out = handleSpecialRemove(r)
+
+	case "/__/net":
+		out = handleSpecialNet(r)
+
+	case "/__/replay-cache":
+		out = handleSpecialReplayCache(r)
+
+	case "/__/status":
+		out = handleSpecialStatus(r)
+
+	case "/__/logs":
+		handleSpecialLogs(w, r)
+
 	default:
 		http.Error(w, "", http.StatusNotFound)
 	}
@@ -136,37 +466,196 @@ func handleSpecial(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleSpecialControl returns an equivalent of Fly's DNS instance discovery.
+// Like Fly, only machines in the requestor's process group are returned.
 func handleSpecialControl(r *http.Request) interface{} {
 	machine := r.URL.Query().Get("machine")
 
+	self := cluster.Lookup(machine)
+
 	c := mesh.ControlInfo{
 		Now: time.Now().UnixMilli(),
 	}
-	for _, i := range allInstances {
+	for _, i := range cluster.Instances() {
 		if *flagAliveOnly && !i.IsAlive() {
 			continue // don't include dead instances
 		}
 		if i.MachineId == machine {
 			continue // don't include requestor
 		}
-		c.Instances = append(c.Instances, mesh.InstanceInfo{
+		if self != nil && (i.App != self.App || i.Group != self.Group) {
+			continue // different app or process group
+		}
+		info := mesh.InstanceInfo{
 			Machine: i.MachineId,
 			Region:  i.Region,
-			Address: "::1",
+			Address: i.PrivateAddr().String(),
 			Port:    i.Port,
-		})
+		}
+		if cluster.Peers != nil && self != nil {
+			// the requestor reaches this peer through its own link
+			link, err := cluster.Peers.Link(self, i)
+			if err != nil {
+				log.Printf("can't link machines, connecting directly: %v", err)
+			} else {
+				info.Address = link.Host()
+				info.Port = link.port
+			}
+		}
+		c.Instances = append(c.Instances, info)
 	}
 
 	return &c
 }
 
-// handleSpecialStart starts all instances immediately.
+// handleSpecialStart starts all instances immediately, including any that had failed.
 func handleSpecialStart(r *http.Request) interface{} {
 	var changes int
-	for _, i := range allInstances {
+	instances := cluster.Instances()
+	for _, i := range instances {
+		i.Reset()
 		if i.EnsureRun() {
 			changes++
 		}
 	}
-	return fmt.Sprintf("ok, started %d/%d", changes, len(allInstances))
+	return fmt.Sprintf("ok, started %d/%d", changes, len(instances))
+}
+
+// handleSpecialScale adds ?count= machines (default 1) to ?region=, which may be new, for the process ?group= (default "app")
+// of ?app= (default -app). They're started unless ?start=0.
+func handleSpecialScale(r *http.Request) interface{} {
+	q := r.URL.Query()
+
+	groupName := q.Get("group")
+	if groupName == "" {
+		groupName = defaultGroup
+	}
+	app := q.Get("app")
+	if app == "" {
+		app = *flagApp
+	}
+	g := cluster.Group(app, groupName)
+	if g == nil {
+		return fmt.Errorf("unknown group=%s (app=%s)", groupName, app)
+	}
+
+	regions, err := parseRegions(q.Get("region"))
+	if err != nil || len(regions) != 1 {
+		return fmt.Errorf("bad region=%s", q.Get("region"))
+	}
+
+	count := 1
+	if raw := q.Get("count"); raw != "" {
+		count, err = strconv.Atoi(raw)
+		if err != nil || count < 1 {
+			return fmt.Errorf("bad count=%s", raw)
+		}
+	}
+
+	out := []InstanceStatus{}
+	for n := 0; n < count; n++ {
+		i, err := cluster.Add(g, regions[0])
+		if err != nil {
+			return err
+		}
+		if q.Get("start") != "0" {
+			i.EnsureRun()
+		}
+		out = append(out, i.Status())
+	}
+	return out
+}
+
+// handleSpecialRemove drains and destroys the comma-separated ?machine= machines.
+func handleSpecialRemove(r *http.Request) interface{} {
+	var remove []*Instance
+	for _, machine := range strings.Split(r.URL.Query().Get("machine"), ",") {
+		i := cluster.Lookup(machine)
+		if i == nil || i.MachineState() == "destroyed" {
+			return fmt.Errorf("unknown machine=%s", machine)
+		}
+		remove = append(remove, i)
+	}
+
+	sig, timeout, err := machinesStopConfig("", nil)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, i := range remove {
+		wg.Add(1)
+		go func(i *Instance) {
+			defer wg.Done()
+			cluster.Remove(i, sig, timeout)
+		}(i)
+	}
+	wg.Wait()
+	return fmt.Sprintf("ok, removed %d", len(remove))
+}
+
+// handleSpecialNet shows and changes how peer traffic is forwarded.
+// It partitions with ?partition=a,b and heals with ?heal=a,b (or ?heal=all), where each is a region or machine.
+// Impairments are set with ?jitter=<duration> and ?drop=<rate>.
+func handleSpecialNet(r *http.Request) interface{} {
+	if cluster.Peers == nil {
+		return fmt.Errorf("peer traffic isn't proxied, remove -peer-proxy=false")
+	}
+	q := r.URL.Query()
+
+	if raw := q.Get("partition"); raw != "" {
+		a, b, err := parsePair(raw)
+		if err != nil {
+			return err
+		}
+		cluster.Peers.Partition(a, b)
+	}
+	if raw := q.Get("heal"); raw == "all" {
+		cluster.Peers.Heal("", "")
+	} else if raw != "" {
+		a, b, err := parsePair(raw)
+		if err != nil {
+			return err
+		}
+		cluster.Peers.Heal(a, b)
+	}
+
+	if q.Has("jitter") || q.Has("drop") {
+		status := cluster.Peers.Status()
+		jitter, drop := status.Jitter, status.Drop
+		var err error
+		if raw := q.Get("jitter"); raw != "" {
+			jitter, err = time.ParseDuration(raw)
+			if err != nil {
+				return err
+			}
+		}
+		if raw := q.Get("drop"); raw != "" {
+			drop, err = strconv.ParseFloat(raw, 64)
+			if err != nil || drop < 0 || drop > 1 {
+				return fmt.Errorf("bad drop=%s", raw)
+			}
+		}
+		cluster.Peers.SetImpairment(jitter, drop)
+	}
+
+	return cluster.Peers.Status()
+}
+
+// handleSpecialReplayCache returns the cached fly-replay responses, first clearing ?clear=<pattern> (or "all").
+func handleSpecialReplayCache(r *http.Request) interface{} {
+	if raw := r.URL.Query().Get("clear"); raw == "all" {
+		cluster.Router.replayCache.Clear("")
+	} else if raw != "" {
+		cluster.Router.replayCache.Clear(raw)
+	}
+	return cluster.Router.replayCache.Status()
+}
+
+// handleSpecialStatus returns the state of every instance, including whether it has failed.
+func handleSpecialStatus(r *http.Request) interface{} {
+	instances := cluster.Instances()
+	out := make([]InstanceStatus, 0, len(instances))
+	for _, i := range instances {
+		out = append(out, i.Status())
+	}
+	return out
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+var buildErrorTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8" />
+<title>Build failed: {{.Package}}</title>
+<style>
+body { margin: 0; padding: 2em; background: #1e1e1e; color: #eee; font-family: sans-serif; }
+h1 { color: #ff6b6b; font-size: 1.4em; }
+pre { background: #000; padding: 1em; overflow: auto; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Build failed: {{.Package}}</h1>
+<pre>{{.Output}}</pre>
+<p>Hangar will rebuild when the sources change.</p>
+</body>
+</html>
+`))
+
+// serveBuildError writes the compiler output as a HTML page, or as JSON if the client prefers it.
+func serveBuildError(w http.ResponseWriter, r *http.Request, be *BuildError) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "build failed",
+			"package": be.Package,
+			"output":  be.Output,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	buildErrorTemplate.Execute(w, be)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	mesh "github.com/samthor/hangar/lib"
+)
+
+const (
+	peerAddress       = "::1" // where links listen, the same as machines
+	peerMinRetransmit = time.Millisecond * 200
+	peerChunkBuffer   = 64
+)
+
+// PeerNet forwards TCP between machines, so that private traffic can be delayed, dropped or partitioned.
+// Each (src, dst) pair of machines gets a link: a port range that src uses to reach dst's ports.
+// Connections to dst are made from the reverse link's ports, so dst sees them as coming from src.
+// Links and those connections share ports with SO_REUSEPORT, where supported.
+// With a PrivateNet, each link is an address instead, listening on the same ports as machines.
+type PeerNet struct {
+	PortStart uint        // link ranges are allocated from here up
+	Private   *PrivateNet // if set, links get addresses rather than port ranges
+	Latency   bool
+
+	lock       sync.RWMutex
+	links      map[[2]*Instance]*peerLink
+	jitter     time.Duration
+	drop       float64
+	partitions [][2]string // pairs of regions or machines
+}
+
+type peerLink struct {
+	src, dst  *Instance
+	addr      netip.Addr // with a PrivateNet
+	port      uint16
+	listeners []net.Listener
+	nextSrc   atomic.Uint32 // rotates through source ports for the reverse direction
+	conns     atomic.Int32
+	total     atomic.Int64
+	refused   atomic.Int64
+}
+
+// PeerLinkStatus describes one link for the control endpoints.
+type PeerLinkStatus struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Address string        `json:"address"`
+	Port    uint16        `json:"port"`
+	Latency time.Duration `json:"latency"`
+	Conns   int           `json:"conns"`
+	Total   int64         `json:"total"`
+	Refused int64         `json:"refused"`
+	Blocked bool          `json:"blocked"`
+}
+
+type PeerNetStatus struct {
+	Jitter     time.Duration    `json:"jitter"`
+	Drop       float64          `json:"drop"`
+	Partitions [][2]string      `json:"partitions"`
+	Links      []PeerLinkStatus `json:"links"`
+}
+
+// Link returns the port range that src dials to reach dst, listening on it if needed.
+func (pn *PeerNet) Link(src, dst *Instance) (*peerLink, error) {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+
+	key := [2]*Instance{src, dst}
+	if l := pn.links[key]; l != nil {
+		return l, nil
+	}
+
+	l := &peerLink{src: src, dst: dst}
+	if pn.Private != nil {
+		used := make(map[netip.Addr]bool)
+		for _, l := range pn.links {
+			used[l.addr] = true
+		}
+		for n := 0; !l.addr.IsValid() || used[l.addr]; n++ {
+			l.addr = pn.Private.Link(n)
+		}
+		if err := pn.Private.Ensure(l.addr); err != nil {
+			return nil, err
+		}
+		l.port = privatePort
+	} else {
+		used := make(map[uint16]bool)
+		for _, l := range pn.links {
+			used[l.port] = true
+		}
+		port := pn.PortStart
+		for used[uint16(port)] {
+			port += mesh.PortRange
+		}
+		if port+mesh.PortRange >= 65536 {
+			return nil, fmt.Errorf("no ports left for link %s->%s", src.MachineId, dst.MachineId)
+		}
+		l.port = uint16(port)
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	for offset := uint16(0); offset < mesh.PortRange; offset++ {
+		addr := net.JoinHostPort(l.Host(), strconv.Itoa(int(l.port+offset)))
+		ln, err := net.Listen("tcp", addr) // check it's free first, as SO_REUSEPORT would share it with another daemon
+		if err == nil {
+			ln.Close()
+			ln, err = lc.Listen(context.Background(), "tcp", addr)
+		}
+		if err != nil {
+			log.Printf("link %s->%s can't use offset=%d: %v", src.MachineId, dst.MachineId, offset, err)
+			continue
+		}
+		l.listeners = append(l.listeners, ln)
+		go pn.accept(l, offset, ln)
+	}
+
+	if pn.links == nil {
+		pn.links = make(map[[2]*Instance]*peerLink)
+	}
+	pn.links[key] = l
+	log.Printf("link %s->%s on %s:%d", src.MachineId, dst.MachineId, l.Host(), l.port)
+	return l, nil
+}
+
+// Host returns the address that src dials to reach dst.
+func (l *peerLink) Host() string {
+	if l.addr.IsValid() {
+		return l.addr.String()
+	}
+	return peerAddress
+}
+
+// Forget closes the links to and from this instance, e.g., once it's destroyed.
+func (pn *PeerNet) Forget(i *Instance) {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	for key, l := range pn.links {
+		if l.src == i || l.dst == i {
+			for _, ln := range l.listeners {
+				ln.Close()
+			}
+			delete(pn.links, key)
+		}
+	}
+}
+
+func (pn *PeerNet) accept(l *peerLink, offset uint16, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // closed by Forget
+		}
+		go pn.serve(l, offset, conn)
+	}
+}
+
+// serve forwards one connection over the link. New connections hang while the link is partitioned, like lost SYNs.
+func (pn *PeerNet) serve(l *peerLink, offset uint16, conn net.Conn) {
+	l.total.Add(1)
+	l.conns.Add(1)
+	defer l.conns.Add(-1)
+
+	pn.waitHealed(l.src, l.dst)
+	if rand.Float64() < pn.dropRate() {
+		l.refused.Add(1)
+		refuse(conn)
+		return
+	}
+	time.Sleep(pn.latency(l.src, l.dst))
+
+	out, err := pn.dial(l, offset)
+	if err != nil {
+		refuse(conn)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pn.pipe(l.src, l.dst, conn, out)
+		close(done)
+	}()
+	pn.pipe(l.dst, l.src, out, conn)
+	<-done
+	conn.Close()
+	out.Close()
+}
+
+// dial connects to dst's port, from a port in the reverse link (or its address) so that dst's ByAddr finds src.
+// Programs only listening on IPv4, or without SO_REUSEPORT, are dialed from any port.
+func (pn *PeerNet) dial(l *peerLink, offset uint16) (net.Conn, error) {
+	target := fmt.Sprintf("[::1]:%d", l.dst.Port+offset)
+
+	reverse, err := pn.Link(l.dst, l.src)
+	if pn.Private != nil {
+		if err == nil {
+			d := net.Dialer{LocalAddr: &net.TCPAddr{IP: reverse.addr.AsSlice()}}
+			if conn, err := d.Dial("tcp", l.dst.HostPort(offset)); err == nil {
+				return conn, nil
+			}
+		}
+		return net.Dial("tcp", l.dst.HostPort(offset))
+	} else if err == nil {
+		for n := 0; n < mesh.PortRange; n++ {
+			src := uint16(reverse.nextSrc.Add(1) % mesh.PortRange)
+			d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv6loopback, Port: int(reverse.port + src)}, Control: reusePort}
+			conn, err := d.Dial("tcp6", target)
+			if err == nil {
+				return conn, nil
+			} else if !errors.Is(err, syscall.EADDRINUSE) {
+				break
+			}
+		}
+	}
+
+	if conn, err := net.Dial("tcp6", target); err == nil {
+		return conn, nil
+	}
+	return net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", l.dst.Port+offset))
+}
+
+// pipe copies from one side to the other, delaying each chunk by latency and jitter.
+// Dropped chunks are delayed as if retransmitted, and delivery stalls while the link is partitioned.
+func (pn *PeerNet) pipe(src, dst *Instance, from, to net.Conn) {
+	type chunk struct {
+		data []byte
+		at   time.Time
+	}
+	ch := make(chan chunk, peerChunkBuffer)
+
+	go func() {
+		defer close(ch)
+		var last time.Time
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := from.Read(buf)
+			if n > 0 {
+				delay := pn.latency(src, dst)
+				if jitter := pn.jitterFor(); jitter > 0 {
+					delay += time.Duration(rand.Int63n(int64(jitter)))
+				}
+				if rand.Float64() < pn.dropRate() {
+					delay += max(peerMinRetransmit, delay*2)
+				}
+				at := time.Now().Add(delay)
+				if at.Before(last) {
+					at = last // keep order
+				}
+				last = at
+				ch <- chunk{data: buf[:n], at: at}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range ch {
+		time.Sleep(time.Until(c.at))
+		pn.waitHealed(src, dst)
+		if _, err := to.Write(c.data); err != nil {
+			from.Close()
+			break
+		}
+	}
+	for range ch {
+		// drain after a write error
+	}
+
+	if tcp, ok := to.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		to.Close()
+	}
+}
+
+// refuse resets the connection, as if it had been refused.
+func refuse(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (pn *PeerNet) latency(src, dst *Instance) time.Duration {
+	if !pn.Latency {
+		return 0
+	}
+	return mesh.VirtualLatency(src.Region, dst.Region)
+}
+
+func (pn *PeerNet) jitterFor() time.Duration {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+	return pn.jitter
+}
+
+func (pn *PeerNet) dropRate() float64 {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+	return pn.drop
+}
+
+// SetImpairment sets the jitter added to each chunk and the rate at which connections and chunks are dropped.
+func (pn *PeerNet) SetImpairment(jitter time.Duration, drop float64) {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	pn.jitter = jitter
+	pn.drop = drop
+}
+
+// Partition blocks traffic between a and b, each a region or machine ID.
+func (pn *PeerNet) Partition(a, b string) {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	pn.partitions = append(pn.partitions, [2]string{a, b})
+	log.Printf("partitioned %s from %s", a, b)
+}
+
+// Heal removes partitions between a and b, or all partitions if both are empty.
+func (pn *PeerNet) Heal(a, b string) {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	var out [][2]string
+	for _, p := range pn.partitions {
+		if a == "" && b == "" || p == [2]string{a, b} || p == [2]string{b, a} {
+			log.Printf("healed %s from %s", p[0], p[1])
+			continue
+		}
+		out = append(out, p)
+	}
+	pn.partitions = out
+}
+
+// isBlocked returns whether traffic between these instances is partitioned.
+func (pn *PeerNet) isBlocked(src, dst *Instance) bool {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+	match := func(name string, i *Instance) bool {
+		return name == i.Region || name == i.MachineId
+	}
+	for _, p := range pn.partitions {
+		if match(p[0], src) && match(p[1], dst) || match(p[1], src) && match(p[0], dst) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pn *PeerNet) waitHealed(src, dst *Instance) {
+	for pn.isBlocked(src, dst) {
+		time.Sleep(readyPollInterval)
+	}
+}
+
+// Status describes the impairments and every link.
+func (pn *PeerNet) Status() PeerNetStatus {
+	pn.lock.RLock()
+	out := PeerNetStatus{
+		Jitter:     pn.jitter,
+		Drop:       pn.drop,
+		Partitions: append([][2]string{}, pn.partitions...),
+		Links:      []PeerLinkStatus{},
+	}
+	var links []*peerLink
+	for _, l := range pn.links {
+		links = append(links, l)
+	}
+	pn.lock.RUnlock()
+
+	sort.Slice(links, func(a, b int) bool {
+		if links[a].addr != links[b].addr {
+			return links[a].addr.Less(links[b].addr)
+		}
+		return links[a].port < links[b].port
+	})
+	for _, l := range links {
+		out.Links = append(out.Links, PeerLinkStatus{
+			From:    l.src.MachineId,
+			To:      l.dst.MachineId,
+			Address: l.Host(),
+			Port:    l.port,
+			Latency: pn.latency(l.src, l.dst),
+			Conns:   int(l.conns.Load()),
+			Total:   l.total.Load(),
+			Refused: l.refused.Load(),
+			Blocked: pn.isBlocked(l.src, l.dst),
+		})
+	}
+	return out
+}
+
+// parsePair parses "a,b" into its two parts.
+func parsePair(raw string) (string, string, error) {
+	a, b, ok := strings.Cut(raw, ",")
+	a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+	if !ok || a == "" || b == "" {
+		return "", "", fmt.Errorf("expected a pair like \"syd,ams\": %q", raw)
+	}
+	return strings.ToLower(a), strings.ToLower(b), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// reusePort does nothing without SO_REUSEPORT, so peers are dialed from any port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
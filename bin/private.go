@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+const (
+	privatePort = 8080 // every machine's $PORT with a PrivateNet, like on Fly
+)
+
+var (
+	privateMachineBase4 = netip.MustParseAddr("127.1.0.1")
+	privateLinkBase4    = netip.MustParseAddr("127.2.0.1")
+	privateMachineBase6 = netip.MustParseAddr("fdaa:0:1::1")
+	privateLinkBase6    = netip.MustParseAddr("fdaa:0:2::1")
+)
+
+// PrivateNet gives each machine its own loopback address, like its private IP on Fly, so every machine listens on privatePort.
+// Peer links get their own addresses too, so a peer's address identifies it.
+// IPv6 addresses are added to the loopback interface, which needs root.
+type PrivateNet struct {
+	IPv6 bool
+
+	lock  sync.Mutex
+	added []netip.Addr // to the loopback interface, removed by Close
+}
+
+// Machine returns the nth machine's address.
+func (pn *PrivateNet) Machine(n int) netip.Addr {
+	if pn.IPv6 {
+		return addrAdd(privateMachineBase6, n)
+	}
+	return addrAdd(privateMachineBase4, n)
+}
+
+// Link returns the nth peer link's address.
+func (pn *PrivateNet) Link(n int) netip.Addr {
+	if pn.IPv6 {
+		return addrAdd(privateLinkBase6, n)
+	}
+	return addrAdd(privateLinkBase4, n)
+}
+
+// Ensure makes sure that addr can be listened on, adding it to the loopback interface if needed.
+func (pn *PrivateNet) Ensure(addr netip.Addr) error {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	if err == nil {
+		return ln.Close()
+	}
+	if err := addLoopback(addr); err != nil {
+		return fmt.Errorf("can't add %v to the loopback interface (try as root): %v", addr, err)
+	}
+	pn.added = append(pn.added, addr)
+	return nil
+}
+
+// Close removes the addresses added to the loopback interface.
+func (pn *PrivateNet) Close() {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	for _, addr := range pn.added {
+		if err := removeLoopback(addr); err != nil {
+			log.Printf("can't remove %v from the loopback interface: %v", addr, err)
+		}
+	}
+	pn.added = nil
+}
+
+// addrAdd returns addr plus n, carrying into higher bytes.
+func addrAdd(addr netip.Addr, n int) netip.Addr {
+	b := addr.As16()
+	carry := n
+	for index := len(b) - 1; index >= 0 && carry != 0; index-- {
+		sum := int(b[index]) + carry
+		b[index] = byte(sum)
+		carry = sum >> 8
+	}
+	out := netip.AddrFrom16(b)
+	if addr.Is4() {
+		return out.Unmap()
+	}
+	return out
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAddrAdd(t *testing.T) {
+	tests := []struct {
+		base string
+		n    int
+		want string
+	}{
+		{"127.1.0.1", 0, "127.1.0.1"},
+		{"127.1.0.1", 255, "127.1.1.0"},
+		{"127.1.0.1", 65536, "127.2.0.1"},
+		{"fdaa:0:1::1", 1, "fdaa:0:1::2"},
+		{"fdaa:0:1::1", 0xffff, "fdaa:0:1::1:0"},
+	}
+
+	for _, tt := range tests {
+		got := addrAdd(netip.MustParseAddr(tt.base), tt.n)
+		if got.String() != tt.want {
+			t.Errorf("addrAdd(%s, %d) = %v, want %s", tt.base, tt.n, got, tt.want)
+		}
+	}
+}
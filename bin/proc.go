@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	mesh "github.com/samthor/hangar/lib"
+)
+
+type listener struct {
+	Port    uint16
+	Pid     int // zero if unknown
+	Command string
+}
+
+// reportStale logs processes already listening in this instance's port range, e.g., leaked by a previous daemon.
+// Logs one line per process, with its ports as ranges.
+func reportStale(i *Instance) {
+	found, err := findListeners(i.Address, i.Port, i.Port+mesh.PortRange)
+	if err != nil {
+		log.Printf("could not check for stale processes: %v", err)
+		return
+	}
+
+	var pids []int
+	byPid := make(map[int][]listener)
+	for _, l := range found {
+		if byPid[l.Pid] == nil {
+			pids = append(pids, l.Pid)
+		}
+		byPid[l.Pid] = append(byPid[l.Pid], l)
+	}
+	sort.Ints(pids)
+
+	for _, pid := range pids {
+		ls := byPid[pid]
+		ports := make([]uint16, len(ls))
+		for index, l := range ls {
+			ports[index] = l.Port
+		}
+		if pid != 0 {
+			log.Printf("machine=%s ports=%s are held by stale pid=%d: %s", i.MachineId, formatPorts(ports), pid, ls[0].Command)
+		} else {
+			log.Printf("machine=%s ports=%s are already in use", i.MachineId, formatPorts(ports))
+		}
+	}
+}
+
+// formatPorts formats ports as ranges, like "8081-8083,8090".
+func formatPorts(ports []uint16) string {
+	sort.Slice(ports, func(a, b int) bool {
+		return ports[a] < ports[b]
+	})
+	var parts []string
+	for start := 0; start < len(ports); {
+		end := start + 1
+		for end < len(ports) && ports[end] <= ports[end-1]+1 {
+			end++
+		}
+		if lo, hi := ports[start], ports[end-1]; lo == hi {
+			parts = append(parts, fmt.Sprint(lo))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", lo, hi))
+		}
+		start = end
+	}
+	return strings.Join(parts, ",")
+}
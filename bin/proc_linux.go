@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcAttr starts the command in its own process group, and has Linux kill it if the daemon dies.
+// Pdeathsig fires when the forking thread exits, which may happen before the daemon does, so this is best-effort.
+func setProcAttr(e *exec.Cmd) {
+	e.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
+
+// findListeners returns processes listening on TCP ports in [lo,hi) on addr (or any address if invalid), via /proc.
+func findListeners(addr netip.Addr, lo, hi uint16) ([]listener, error) {
+	inodes := make(map[string]uint16)
+	for _, name := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		err := readListenInodes(name, addr, lo, hi, inodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(inodes) == 0 {
+		return nil, nil
+	}
+
+	var out []listener
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(filepath.Base(proc))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		fds, _ := os.ReadDir(filepath.Join(proc, "fd"))
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(proc, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			port, ok := inodes[inode]
+			if !ok {
+				continue
+			}
+
+			cmdline, _ := os.ReadFile(filepath.Join(proc, "cmdline"))
+			out = append(out, listener{
+				Port:    port,
+				Pid:     pid,
+				Command: strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " ")),
+			})
+		}
+	}
+	return out, nil
+}
+
+// readListenInodes reads a /proc/net/tcp file and adds listening sockets in [lo,hi) on addr (or any address) to inodes.
+func readListenInodes(name string, addr netip.Addr, lo, hi uint16, inodes map[string]uint16) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Scan() // skip header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || fields[3] != "0A" {
+			continue // not TCP_LISTEN
+		}
+
+		rawAddr, rawPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			return fmt.Errorf("bad local_address in %s: %q", name, fields[1])
+		}
+		port, err := strconv.ParseUint(rawPort, 16, 16)
+		if err != nil {
+			return err
+		}
+		if uint16(port) < lo || uint16(port) >= hi {
+			continue
+		}
+		if addr.IsValid() {
+			local, err := parseProcAddr(rawAddr)
+			if err != nil {
+				return err
+			}
+			if local != addr && !local.IsUnspecified() {
+				continue // another address, wildcards conflict with everything
+			}
+		}
+		inodes[fields[9]] = uint16(port)
+	}
+	return s.Err()
+}
+
+// parseProcAddr parses an address from /proc/net/tcp, which is hex in 32-bit words of host (little-endian) order.
+func parseProcAddr(raw string) (netip.Addr, error) {
+	b, err := hex.DecodeString(raw)
+	if err != nil || len(b)%4 != 0 {
+		return netip.Addr{}, fmt.Errorf("bad address in /proc/net/tcp: %q", raw)
+	}
+	for index := 0; index < len(b); index += 4 {
+		b[index], b[index+1], b[index+2], b[index+3] = b[index+3], b[index+2], b[index+1], b[index]
+	}
+	out, _ := netip.AddrFromSlice(b)
+	return out.Unmap(), nil
+}
+
+// addLoopback adds addr to the loopback interface. IPv4 addresses in 127.0.0.0/8 already work.
+func addLoopback(addr netip.Addr) error {
+	args := []string{"addr", "add", netip.PrefixFrom(addr, addr.BitLen()).String(), "dev", "lo"}
+	if addr.Is6() {
+		args = append(args, "nodad")
+	}
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeLoopback removes addr from the loopback interface.
+func removeLoopback(addr netip.Addr) error {
+	out, err := exec.Command("ip", "addr", "del", netip.PrefixFrom(addr, addr.BitLen()).String(), "dev", "lo").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// findListeners returns ports in [lo,hi) that can't be listened on at addr (or localhost if invalid). The process is unknown.
+func findListeners(addr netip.Addr, lo, hi uint16) ([]listener, error) {
+	host := "localhost"
+	if addr.IsValid() {
+		host = addr.String()
+	}
+
+	var out []listener
+	for port := lo; port < hi; port++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+		if err != nil {
+			out = append(out, listener{Port: port})
+			continue
+		}
+		ln.Close()
+	}
+	return out, nil
+}
+
+// addLoopback adds addr as an alias of the loopback interface.
+func addLoopback(addr netip.Addr) error {
+	return ifconfigLoopback(addr, "alias")
+}
+
+// removeLoopback removes addr from the loopback interface.
+func removeLoopback(addr netip.Addr) error {
+	return ifconfigLoopback(addr, "-alias")
+}
+
+func ifconfigLoopback(addr netip.Addr, op string) error {
+	args := []string{"lo0", op, addr.String()}
+	if addr.Is6() {
+		args = []string{"lo0", "inet6", addr.String(), "prefixlen", "128", op}
+	}
+	out, err := exec.Command("ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
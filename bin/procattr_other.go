@@ -0,0 +1,15 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcAttr starts the command in its own process group.
+func setProcAttr(e *exec.Cmd) {
+	e.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerReplayCache        = "fly-replay-cache"
+	headerReplayCacheTTL     = "fly-replay-cache-ttl-secs"
+	headerReplayCacheControl = "fly-replay-cache-control"
+	replayCacheMinTTL        = time.Second * 10
+)
+
+// ReplayCache remembers fly-replay responses by path pattern, like fly-replay-cache, so that matching requests skip the hop.
+type ReplayCache struct {
+	lock    sync.Mutex
+	entries map[string]*replayCacheEntry
+}
+
+type replayCacheEntry struct {
+	source  *Instance // the machine which replayed
+	replay  string
+	target  string // from instance=, if any
+	expires time.Time
+	hits    int64
+}
+
+// ReplayCacheStatus describes one cached replay for the control endpoints.
+type ReplayCacheStatus struct {
+	Pattern string    `json:"pattern"`
+	Replay  string    `json:"replay"`
+	Source  string    `json:"source"`
+	Expires time.Time `json:"expires"`
+	Hits    int64     `json:"hits"`
+}
+
+// Set caches this replay for requests matching pattern.
+func (rc *ReplayCache) Set(pattern string, ttl time.Duration, source *Instance, replay, target string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.entries == nil {
+		rc.entries = make(map[string]*replayCacheEntry)
+	}
+	rc.entries[pattern] = &replayCacheEntry{
+		source:  source,
+		replay:  replay,
+		target:  target,
+		expires: time.Now().Add(ttl),
+	}
+	log.Printf("caching fly-replay=%q for %s from machine=%s (ttl=%v)", replay, pattern, source.MachineId, ttl)
+}
+
+// Match returns the cached replay for this path, using the longest matching pattern.
+func (rc *ReplayCache) Match(path string) (*Instance, string, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	now := time.Now()
+	var best string
+	for pattern, e := range rc.entries {
+		if now.After(e.expires) {
+			delete(rc.entries, pattern)
+		} else if matchReplayPattern(pattern, path) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	e := rc.entries[best]
+	if e == nil {
+		return nil, "", false
+	}
+	e.hits++
+	return e.source, e.replay, true
+}
+
+// Forget removes cached replays from or to this machine, e.g., once it's removed.
+func (rc *ReplayCache) Forget(machine string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for pattern, e := range rc.entries {
+		if e.target == machine || e.source.MachineId == machine {
+			delete(rc.entries, pattern)
+		}
+	}
+}
+
+// Clear removes the cached replay for pattern, or every cached replay if it's empty.
+func (rc *ReplayCache) Clear(pattern string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for other := range rc.entries {
+		if pattern == "" || other == pattern {
+			delete(rc.entries, other)
+		}
+	}
+}
+
+// Status describes every unexpired cached replay.
+func (rc *ReplayCache) Status() []ReplayCacheStatus {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	out := []ReplayCacheStatus{}
+	now := time.Now()
+	for pattern, e := range rc.entries {
+		if now.After(e.expires) {
+			continue
+		}
+		out = append(out, ReplayCacheStatus{
+			Pattern: pattern,
+			Replay:  e.replay,
+			Source:  e.source.MachineId,
+			Expires: e.expires,
+			Hits:    e.hits,
+		})
+	}
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].Pattern < out[b].Pattern
+	})
+	return out
+}
+
+// matchReplayPattern returns whether path matches a pattern like "/users/123" or "/users/123/*".
+func matchReplayPattern(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return pattern == path
+}
+
+// parseReplayCache checks a fly-replay-cache pattern against the path it was returned for, and parses its TTL.
+// TTLs under replayCacheMinTTL are raised to it.
+func parseReplayCache(pattern, rawTTL, path string) (time.Duration, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return 0, fmt.Errorf("pattern must start with \"/\"")
+	}
+	if !matchReplayPattern(pattern, path) {
+		return 0, fmt.Errorf("pattern doesn't match path=%s", path)
+	}
+	if rawTTL == "" {
+		return 0, fmt.Errorf("no %s", headerReplayCacheTTL)
+	}
+	seconds, err := strconv.Atoi(rawTTL)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("bad %s=%s", headerReplayCacheTTL, rawTTL)
+	}
+	return max(time.Duration(seconds)*time.Second, replayCacheMinTTL), nil
+}
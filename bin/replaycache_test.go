@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReplayCache(t *testing.T) {
+	tests := []struct {
+		pattern, ttl, path string
+		want               time.Duration
+		ok                 bool
+	}{
+		{"/users/*", "60", "/users/123", time.Minute, true},
+		{"/users/123", "60", "/users/123", time.Minute, true},
+		{"/users/*", "1", "/users/123", replayCacheMinTTL, true},
+		{"/users/123", "60", "/users/1234", 0, false},
+		{"users/*", "60", "users/123", 0, false},
+		{"/users/*", "", "/users/123", 0, false},
+		{"/users/*", "soon", "/users/123", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseReplayCache(tt.pattern, tt.ttl, tt.path)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseReplayCache(%q, %q, %q) = %v, %v", tt.pattern, tt.ttl, tt.path, got, err)
+		}
+	}
+}
+
+func TestReplayCacheForget(t *testing.T) {
+	a := &Instance{MachineId: "a"}
+	b := &Instance{MachineId: "b"}
+
+	var rc ReplayCache
+	rc.Set("/from/*", time.Minute, a, "region=ams", "")
+	rc.Set("/to/*", time.Minute, b, "instance=a", "a")
+	rc.Set("/other/*", time.Minute, b, "region=syd", "")
+
+	rc.Forget("a")
+	if _, _, ok := rc.Match("/from/1"); ok {
+		t.Errorf("replay from forgotten machine still cached")
+	}
+	if _, _, ok := rc.Match("/to/1"); ok {
+		t.Errorf("replay to forgotten machine still cached")
+	}
+	if _, _, ok := rc.Match("/other/1"); !ok {
+		t.Errorf("unrelated replay was forgotten")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	restartBackoffMin  = time.Millisecond * 500
+	restartBackoffMax  = time.Second * 30
+	restartStableAfter = time.Second * 30 // reset backoff if a machine runs this long
+)
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNo        = "no"
+)
+
+// RestartPolicy matches Fly's machine restart policies.
+type RestartPolicy struct {
+	Policy     string
+	MaxRetries int // only for "on-failure"
+}
+
+func parseRestartPolicy(policy string, maxRetries int) (RestartPolicy, error) {
+	switch policy {
+	case RestartAlways, RestartOnFailure, RestartNo:
+		return RestartPolicy{Policy: policy, MaxRetries: maxRetries}, nil
+	}
+	return RestartPolicy{}, fmt.Errorf("unknown restart policy: %q", policy)
+}
+
+// restartBackoff returns the delay before the given restart: the first is immediate, then it doubles.
+func restartBackoff(restarts int) time.Duration {
+	if restarts == 0 {
+		return 0
+	}
+	delay := restartBackoffMin
+	for j := 1; j < restarts && delay < restartBackoffMax; j++ {
+		delay *= 2
+	}
+	return min(delay, restartBackoffMax)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mesh "github.com/samthor/hangar/lib"
@@ -20,12 +24,15 @@ type routerState struct {
 	replays      int
 	replayHeader *mesh.FlyReplayHeader
 	target       mesh.FlyReplayHeader
+	exclude      *Instance // for elsewhere=true
+	body         []byte    // buffered so it can be sent again on replay
+	streaming    bool      // the body was too large to buffer, so can't be replayed
 	ro           *Router
 	w            http.ResponseWriter
 	r            *http.Request
 }
 
-func (rs *routerState) Replay(i *Instance, replay string) {
+func (rs *routerState) Replay(i *Instance, re *ErrReplay) {
 	if rs.replays > *flagReplayCount {
 		log.Printf("Got excessively replayed request: url=%v", rs.r.URL)
 		http.Error(rs.w, "", http.StatusInternalServerError)
@@ -33,14 +40,28 @@ func (rs *routerState) Replay(i *Instance, replay string) {
 	}
 	rs.replays++
 
-	var info mesh.FlyReplayHeader
-	parseRecord(replay, &info)
+	if rs.streaming {
+		rs.fail(http.StatusRequestEntityTooLarge, "fly-replay from machine=%s: request body is over %d bytes, too large to replay", i.MachineId, *flagReplayBody)
+		return
+	}
+	rs.rewind()
 
-	if info.Instance != "" || info.App != "" || info.Elsewhere {
-		log.Printf("Unhandled replay header: %+v", info)
-		http.Error(rs.w, "", http.StatusInternalServerError)
+	if re.Cache != "" {
+		rs.cache(i, re)
+	}
+	rs.route(i, re.Replay)
+}
+
+// route sends the request to the target of this replay from i.
+func (rs *routerState) route(i *Instance, replay string) {
+	info, err := parseReplay(replay)
+	if err != nil {
+		rs.fail(http.StatusBadGateway, "fly-replay from machine=%s: %v", i.MachineId, err)
 		return
 	}
+	if info.App == "" {
+		info.App = i.App
+	}
 	rs.target = info
 
 	// this is "where we were from", not where we're going
@@ -49,34 +70,290 @@ func (rs *routerState) Replay(i *Instance, replay string) {
 		Region:   i.Region,
 		State:    info.State,
 	}
+	rs.r.Header.Set("fly-replay-src", replayForRequestHeader(rs.replayHeader))
+
+	rs.exclude = nil
+	if info.Elsewhere {
+		rs.exclude = i
+	}
+
+	if !rs.ro.hasApp(info.App) {
+		rs.fail(http.StatusBadGateway, "fly-replay: no app=%s", info.App)
+		return
+	}
+
+	if info.Instance != "" {
+		target := cluster.Lookup(info.Instance)
+		if target == nil || target.App != info.App || target.MachineState() == "destroyed" {
+			rs.fail(http.StatusBadGateway, "fly-replay: no machine=%s in app=%s", info.Instance, info.App)
+			return
+		}
+		rs.ro.serveInstance(rs, target, rs.w, rs.r)
+		return
+	}
 
 	rs.ro.serveForRegion(rs, rs.w, rs.r)
 }
 
+// cache remembers this replay for requests matching its fly-replay-cache pattern.
+func (rs *routerState) cache(i *Instance, re *ErrReplay) {
+	ttl, err := parseReplayCache(re.Cache, re.CacheTTL, rs.r.URL.Path)
+	if err != nil {
+		log.Printf("ignoring fly-replay-cache=%s from machine=%s: %v", re.Cache, i.MachineId, err)
+		return
+	}
+	info, err := parseReplay(re.Replay)
+	if err != nil {
+		return // route fails
+	}
+	rs.ro.replayCache.Set(re.Cache, ttl, i, re.Replay, info.Instance)
+}
+
+// bufferBody reads the request's body, up to -replay-body bytes, so that it can be sent again on replay.
+// Larger bodies are streamed through instead.
+func (rs *routerState) bufferBody() error {
+	body := rs.r.Body
+	if body == nil || body == http.NoBody {
+		return nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(body, *flagReplayBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > *flagReplayBody {
+		rs.streaming = true
+		rs.r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+		return nil
+	}
+
+	body.Close()
+	rs.body = buf
+	rs.rewind()
+	return nil
+}
+
+// rewind resets the request's body to the start of the buffered body.
+func (rs *routerState) rewind() {
+	if rs.body != nil {
+		rs.r.Body = io.NopCloser(bytes.NewReader(rs.body))
+	}
+}
+
+// fail logs and returns an error for this request.
+func (rs *routerState) fail(status int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("%s (url=%v)", msg, rs.r.URL)
+	http.Error(rs.w, msg, status)
+}
+
+// parseReplay parses a fly-replay header like "region=syd;state=foo" or "elsewhere=true".
+func parseReplay(raw string) (mesh.FlyReplayHeader, error) {
+	var record struct {
+		Region    string `json:"region"`
+		Instance  string `json:"instance"`
+		App       string `json:"app"`
+		State     string `json:"state"`
+		Elsewhere string `json:"elsewhere"`
+	}
+	err := parseRecord(raw, &record)
+	if err != nil {
+		return mesh.FlyReplayHeader{}, err
+	}
+
+	out := mesh.FlyReplayHeader{
+		Region:   record.Region,
+		Instance: record.Instance,
+		App:      record.App,
+		State:    record.State,
+	}
+	if record.Elsewhere != "" {
+		out.Elsewhere, err = strconv.ParseBool(record.Elsewhere)
+		if err != nil {
+			return out, fmt.Errorf("bad elsewhere=%s", record.Elsewhere)
+		}
+	}
+	if out.Region == "" && out.Instance == "" && out.App == "" && !out.Elsewhere {
+		return out, fmt.Errorf("no target in %q", raw)
+	}
+	return out, nil
+}
+
+// Concurrency is like Fly's [http_service.concurrency], applied to every machine.
+// Load is the number of requests in flight. With "connections", each of those has its own connection to the machine.
+type Concurrency struct {
+	Type         string // "requests" or "connections"
+	SoftLimit    int    // over this, prefer other machines (or start more)
+	HardLimit    int    // at this, queue requests (0 for no limit)
+	QueueTimeout time.Duration
+}
+
 type Router struct {
 	regionToInstance map[string]InstanceList
 	defaultRegion    string
+	builds           []*Build // requests fail while any of these can't build
+	concurrency      Concurrency
+	app              string // public requests go to this app
+	replayCache      ReplayCache
+	clientRegion     string // where requests come from, or "" for no latency
+	lock             sync.RWMutex
+}
+
+// latency returns the virtual latency between the client and this instance, each way.
+func (ro *Router) latency(i *Instance) time.Duration {
+	if ro.clientRegion == "" {
+		return 0
+	}
+	return mesh.VirtualLatency(ro.clientRegion, i.Region)
+}
+
+// add routes requests to this instance.
+func (ro *Router) add(i *Instance) {
+	ro.lock.Lock()
+	defer ro.lock.Unlock()
+	ro.regionToInstance[i.Region] = append(ro.regionToInstance[i.Region], i)
+}
+
+// remove stops routing requests to this instance, including cached replays to it.
+func (ro *Router) remove(i *Instance) {
+	ro.replayCache.Forget(i.MachineId)
+
+	ro.lock.Lock()
+	defer ro.lock.Unlock()
+
+	var out InstanceList
+	for _, other := range ro.regionToInstance[i.Region] {
+		if other != i {
+			out = append(out, other)
+		}
+	}
+	if len(out) == 0 {
+		delete(ro.regionToInstance, i.Region)
+	} else {
+		ro.regionToInstance[i.Region] = out
+	}
+}
+
+// table returns the app's instances for each region, without exclude (which may be nil).
+func (ro *Router) table(app string, exclude *Instance) map[string]InstanceList {
+	ro.lock.RLock()
+	defer ro.lock.RUnlock()
+	out := make(map[string]InstanceList, len(ro.regionToInstance))
+	for region, il := range ro.regionToInstance {
+		var options InstanceList
+		for _, i := range il {
+			if i.App == app && i != exclude {
+				options = append(options, i)
+			}
+		}
+		if len(options) != 0 {
+			out[region] = options
+		}
+	}
+	return out
+}
+
+// apps returns the names of every app with routed instances.
+func (ro *Router) apps() []string {
+	ro.lock.RLock()
+	defer ro.lock.RUnlock()
+	seen := make(map[string]bool)
+	var out []string
+	for _, il := range ro.regionToInstance {
+		for _, i := range il {
+			if !seen[i.App] {
+				seen[i.App] = true
+				out = append(out, i.App)
+			}
+		}
+	}
+	return out
+}
+
+// hasApp returns whether any routed instance is part of this app.
+func (ro *Router) hasApp(app string) bool {
+	return len(ro.table(app, nil)) != 0
 }
 
 func (ro *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, b := range ro.builds {
+		if b.Err() == nil {
+			continue
+		}
+		// retry the build (only if the sources changed), otherwise show the error
+		if _, err := b.Binary(); err != nil {
+			serveBuildError(w, r, err.(*BuildError))
+			return
+		}
+	}
+
 	rs := &routerState{
 		ro: ro,
 		w:  w,
 		r:  r,
 		target: mesh.FlyReplayHeader{
 			Region: r.Header.Get(headerPreferRegion),
+			App:    ro.app,
 		},
 	}
+	if err := rs.bufferBody(); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get(headerReplayCacheControl) != "skip" {
+		if source, replay, ok := ro.replayCache.Match(r.URL.Path); ok {
+			rs.route(source, replay)
+			return
+		}
+	}
 	ro.serveForRegion(rs, w, r)
 }
 
+// serveInstance sends the request to exactly this instance, starting it if needed.
+func (ro *Router) serveInstance(rs *routerState, i *Instance, w http.ResponseWriter, r *http.Request) {
+	if i.IsFailed() {
+		rs.fail(http.StatusServiceUnavailable, "machine=%s has failed", i.MachineId)
+		return
+	}
+	if !i.IsAlive() || !i.IsReady() {
+		i.EnsureRun()
+		if !i.WaitReady(*flagStartTimeout) {
+			rs.fail(http.StatusServiceUnavailable, "machine=%s not ready after %v", i.MachineId, *flagStartTimeout)
+			return
+		}
+	}
+
+	deadline := time.Now().Add(ro.concurrency.QueueTimeout)
+	for !ro.acquire(i) {
+		if time.Now().After(deadline) || r.Context().Err() != nil {
+			rs.fail(http.StatusServiceUnavailable, "machine=%s is at its hard_limit=%d", i.MachineId, ro.concurrency.HardLimit)
+			return
+		}
+		time.Sleep(readyPollInterval)
+	}
+	if !i.SendTo(rs.Replay, ro.latency(i), w, r) {
+		rs.fail(http.StatusBadGateway, "machine=%s refused the connection", i.MachineId)
+	}
+}
+
 func (ro *Router) serveForRegion(rs *routerState, w http.ResponseWriter, r *http.Request) {
 	region := strings.ToLower(strings.TrimSpace(rs.target.Region))
+	table := ro.table(rs.target.App, rs.exclude)
+
+	if rs.exclude != nil && len(table) == 0 {
+		rs.fail(http.StatusServiceUnavailable, "fly-replay: no machines other than machine=%s", rs.exclude.MachineId)
+		return
+	}
 
-	if region == "" || ro.regionToInstance[region] == nil {
+	if region == "" || table[region] == nil {
 		region = ro.defaultRegion
-		if ro.regionToInstance[region] == nil {
-			for cand := range ro.regionToInstance {
+		if table[region] == nil {
+			region = ""
+			for cand := range table {
 				region = cand // choose random region
 				break
 			}
@@ -87,45 +364,82 @@ func (ro *Router) serveForRegion(rs *routerState, w http.ResponseWriter, r *http
 		}
 	}
 
-	if rs.replayHeader != nil {
-		r.Header.Set("fly-replay-src", replayForRequestHeader(rs.replayHeader))
-	}
+	options := table[region]
 
-	options := ro.regionToInstance[region]
-	if len(options) == 0 {
-		panic(fmt.Sprintf("got invalid region: %s", region))
+	// fast-path: find the first region-matched passing instance under its soft limit
+	for _, i := range options {
+		if i.IsAlive() && i.Health() == CheckPassing && i.Requests() < ro.concurrency.SoftLimit && ro.acquire(i) {
+			if i.SendTo(rs.Replay, ro.latency(i), w, r) {
+				return
+			}
+		}
 	}
 
-	// fast-path: find the first region-matched instance handling few requests
+	// otherwise, start an instance (or use one already starting), holding the request until it's ready
 	for _, i := range options {
-		if i.IsAlive() && i.Requests() < *flagActive && i.SendTo(rs.Replay, w, r) {
+		if !(*flagAutoStart && i.EnsureRun()) && !i.IsStarting() {
+			continue // we decided all alive weren't good
+		}
+
+		if !i.WaitReady(*flagStartTimeout) {
+			log.Printf("machine=%s not ready after %v", i.MachineId, *flagStartTimeout)
+			continue
+		}
+		if ro.acquire(i) && i.SendTo(rs.Replay, ro.latency(i), w, r) {
 			return
 		}
 	}
 
-	// otherwise, start an instance
+	// otherwise, go random (but never to failed or drained instances, or stopped ones without auto-start)
+	var candidates InstanceList
 	for _, i := range options {
-		if !i.EnsureRun() {
-			continue // we decided all alive weren't good
+		if !i.IsFailed() && !i.IsDraining() && (*flagAutoStart || i.Active()) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		// try anything alive in another region, e.g., this region is being restarted
+		for _, other := range table {
+			for _, i := range other {
+				if i.IsAlive() {
+					candidates = append(candidates, i)
+				}
+			}
 		}
+	}
+	if len(candidates) == 0 {
+		http.Error(w, fmt.Sprintf("no machines available for region=%s", region), http.StatusServiceUnavailable)
+		return
+	}
 
-		delayPart := healthyTimeout / healthyRetries
-		for j := 0; j < healthyRetries; j++ {
-			if i.SendTo(rs.Replay, w, r) {
+	// queue while every candidate is at its hard limit
+	deadline := time.Now().Add(ro.concurrency.QueueTimeout)
+	for {
+		for _, index := range rand.Perm(len(candidates)) {
+			choice := candidates[index]
+			if !ro.acquire(choice) {
+				continue
+			}
+			if choice.SendTo(rs.Replay, ro.latency(choice), w, r) {
 				return
 			}
-			time.Sleep(delayPart)
+			// can't find a matching region instance
+			http.Error(w, "", http.StatusInternalServerError)
+			return
 		}
-	}
 
-	// otherwise, go random
-	choice := options[rand.Intn(len(options))]
-	if choice.SendTo(rs.Replay, w, r) {
-		return
+		if time.Now().After(deadline) || r.Context().Err() != nil {
+			break
+		}
+		time.Sleep(readyPollInterval)
 	}
+	log.Printf("request to region=%s queued for %v, machines at hard_limit=%d", region, ro.concurrency.QueueTimeout, ro.concurrency.HardLimit)
+	http.Error(w, fmt.Sprintf("all machines in region=%s are at their hard_limit", region), http.StatusServiceUnavailable)
+}
 
-	// can't find a matching region instance
-	http.Error(w, "", http.StatusInternalServerError)
+// acquire reserves a request on this instance, if it's under the hard limit.
+func (ro *Router) acquire(i *Instance) bool {
+	return i.acquire(ro.concurrency.HardLimit)
 }
 
 // ForRequestHeader writes this FlyReplayHeader for the server making a replay request.
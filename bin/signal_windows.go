@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var (
+	// Windows has no SIGUSR1 or SIGUSR2, and can only deliver SIGKILL to another process.
+	signalNames = map[string]syscall.Signal{
+		"SIGHUP":  syscall.SIGHUP,
+		"SIGINT":  syscall.SIGINT,
+		"SIGQUIT": syscall.SIGQUIT,
+		"SIGKILL": syscall.SIGKILL,
+		"SIGTERM": syscall.SIGTERM,
+	}
+)
+
+// signalGroup sends sig to p. Windows has no process groups, so processes it forked are left running.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	err := p.Signal(sig)
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil // already gone
+	}
+	return err
+}
+
+// setProcAttr does nothing, as Windows has no process groups.
+func setProcAttr(e *exec.Cmd) {}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	watchDebounce     = time.Millisecond * 200
+	watchStartTimeout = time.Second * 30
+)
+
+// watchAndRestart rebuilds when files in the package's module change, then restarts running instances one at a time.
+func watchAndRestart(build *Build, sig os.Signal, killTimeout time.Duration) {
+	dir, err := build.ModuleDir()
+	if err != nil {
+		log.Fatalf("can't watch: %v", err)
+	}
+	ch, err := watchDir(dir)
+	if err != nil {
+		log.Fatalf("can't watch dir=%s: %v", dir, err)
+	}
+	log.Printf("watching dir=%s for changes", dir)
+
+	for range ch {
+		// editors often write several events: wait until they stop
+		for {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(watchDebounce):
+			}
+			break
+		}
+
+		changed, err := build.Rebuild()
+		if err != nil {
+			log.Printf("%v, not restarting", err)
+			continue
+		} else if !changed {
+			continue
+		}
+		rollingRestart(build, sig, killTimeout)
+	}
+}
+
+// rollingRestart restarts every running instance of the build one at a time, like a rolling deploy.
+// Each is taken out of routing, drained, stopped and restarted, and is routed to again once it's ready.
+func rollingRestart(build *Build, sig os.Signal, killTimeout time.Duration) {
+	for _, i := range cluster.Instances() {
+		if i.Build != build || !i.IsAlive() {
+			continue // will start with the new binary
+		}
+		log.Printf("machine=%s restarting with new build", i.MachineId)
+
+		i.Drain(killTimeout)
+		i.Stop(sig, killTimeout)
+		i.EnsureRun()
+		if !i.WaitReady(watchStartTimeout) {
+			log.Printf("machine=%s was not ready after %v", i.MachineId, watchStartTimeout)
+		}
+		i.SetDraining(false)
+	}
+}
+
+// skipWatch returns whether this directory should not be watched, e.g., ".git".
+func skipWatch(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") || name == "node_modules"
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"time"
+)
+
+const watchPollInterval = time.Second
+
+// watchDir notifies on an interval: without inotify, the build's source hash decides whether anything changed.
+func watchDir(dir string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	go func() {
+		for range time.Tick(watchPollInterval) {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
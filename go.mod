@@ -2,4 +2,8 @@ module github.com/samthor/hangar
 
 go 1.21.3
 
-require golang.org/x/sync v0.5.0
+require (
+	github.com/BurntSushi/toml v1.4.0
+	golang.org/x/sync v0.5.0
+	golang.org/x/sys v0.15.0
+)
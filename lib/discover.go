@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -16,12 +17,39 @@ var (
 	flyDefaultPort = uint16(8080)
 )
 
+// Resolver looks up Fly's .internal names.
+// Locally, it uses the daemon's DNS server if LOCAL_DNS_ADDR is set.
+var Resolver = net.DefaultResolver
+
+func init() {
+	if localDNSAddr != "" {
+		Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				ip := net.ParseIP(localAddress)
+				host, _, _ := net.SplitHostPort(localDNSAddr)
+				if server := net.ParseIP(host); ip != nil && server != nil && (ip.To4() == nil) == (server.To4() == nil) {
+					// like on Fly, query from our own address, so the server knows who's asking
+					if strings.HasPrefix(network, "udp") {
+						d.LocalAddr = &net.UDPAddr{IP: ip}
+					} else {
+						d.LocalAddr = &net.TCPAddr{IP: ip}
+					}
+				}
+				return d.DialContext(ctx, network, localDNSAddr)
+			},
+		}
+	}
+}
+
 type flyInstance struct {
 	Instance     string `json:"instance"` // the ID of the instance
 	App          string `json:"app"`
 	PrivateIp    string `json:"ip"`
 	ProcessGroup string `json:"processGroup"`
 	Region       string `json:"region"`
+	Port         uint16 `json:"port,string,omitempty"` // only set locally, where machines share an IP
 }
 
 // Discover finds mesh instances for this process. This excludes ourselves.
@@ -31,8 +59,8 @@ func Discover(ctx context.Context) (*ControlInfo, error) {
 		Now: time.Now().UnixMilli(),
 	}
 
-	// Fetch information from the local controller.
-	if localControlUrl != "" {
+	// Fetch information from the local controller, unless we're using its DNS server.
+	if localControlUrl != "" && localDNSAddr == "" {
 		resp, err := http.Get(localControlUrl)
 		if err != nil {
 			return nil, err
@@ -44,8 +72,8 @@ func Discover(ctx context.Context) (*ControlInfo, error) {
 		return &out, err
 	}
 
-	// Fetch information from Fly.
-	if flyMachine != "" {
+	// Fetch information from Fly (or the local DNS server).
+	if flyMachine != "" || localDNSAddr != "" {
 		eg, _ := errgroup.WithContext(ctx)
 
 		ipMap := make(map[string]bool)
@@ -53,7 +81,7 @@ func Discover(ctx context.Context) (*ControlInfo, error) {
 
 		eg.Go(func() error {
 			// This limits to the actual process group, which _instances does not, below
-			ret, err := net.LookupIP(fmt.Sprintf("%s.process.%s.internal", flyProcessGroup, flyAppName))
+			ret, err := Resolver.LookupIP(ctx, "ip", fmt.Sprintf("%s.process.%s.internal", flyProcessGroup, flyAppName))
 			if err != nil {
 				return err
 			}
@@ -63,7 +91,7 @@ func Discover(ctx context.Context) (*ControlInfo, error) {
 			return nil
 		})
 		eg.Go(func() error {
-			raw, err := net.LookupTXT("_instances.internal")
+			raw, err := Resolver.LookupTXT(ctx, "_instances.internal")
 			if err != nil || len(raw) == 0 {
 				return err
 			}
@@ -83,6 +111,9 @@ func Discover(ctx context.Context) (*ControlInfo, error) {
 			if ok := ipMap[fi.PrivateIp]; !ok {
 				continue // not part of right process group
 			}
+			if (fi.App != "" && fi.App != flyAppName) || (fi.ProcessGroup != "" && fi.ProcessGroup != flyProcessGroup) {
+				continue // locally, every machine has the same IP
+			}
 
 			i := InstanceInfo{
 				Machine: fi.Instance,
@@ -90,6 +121,9 @@ func Discover(ctx context.Context) (*ControlInfo, error) {
 				Address: fi.PrivateIp,
 				Port:    flyDefaultPort,
 			}
+			if fi.Port != 0 {
+				i.Port = fi.Port
+			}
 
 			// check this logic in case we get weird results
 			if !i.IsSelf() {
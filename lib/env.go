@@ -10,6 +10,8 @@ var (
 	localMachine    = os.Getenv("LOCAL_MACHINE_ID")
 	localControlUrl = os.Getenv("LOCAL_CONTROL_URL")
 	localRegion     = os.Getenv("LOCAL_REGION")
+	localDNSAddr    = os.Getenv("LOCAL_DNS_ADDR")
+	localAddress    = os.Getenv("LOCAL_ADDRESS") // set if this machine has its own address, rather than sharing "::1"
 	flyMachine      = os.Getenv("FLY_MACHINE_ID")
 	flyProcessGroup = os.Getenv("FLY_PROCESS_GROUP")
 	flyAppName      = os.Getenv("FLY_APP_NAME")
@@ -45,6 +47,9 @@ func init() {
 			Address: "::1",
 			Port:    port,
 		}
+		if localAddress != "" {
+			selfInstance.Address = localAddress
+		}
 	} else {
 		selfInstance = InstanceInfo{
 			Machine: "zzxxzzxx",
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 )
@@ -11,6 +12,8 @@ import (
 func PrivateHost() string {
 	if flyMachine != "" {
 		return "fly-local-6pn"
+	} else if localAddress != "" {
+		return localAddress
 	}
 	return "localhost"
 }
@@ -50,10 +53,13 @@ func ListenPortOffset(offset uint16) string {
 	var host string
 	if IsDeploy() {
 		// be explicit for... reasons
-		host = "[::]"
+		host = "::"
+	} else if localAddress != "" {
+		// our own loopback address, like our private IP
+		host = localAddress
 	} else {
 		// stop egregious firewalls; if you need local dev network access...?
-		host = "[::1]"
+		host = "::1"
 	}
-	return fmt.Sprintf("%s:%d", host, PortOffset(offset))
+	return net.JoinHostPort(host, strconv.Itoa(PortOffset(offset)))
 }
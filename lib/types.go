@@ -10,7 +10,7 @@ import (
 )
 
 const (
-	// PortRange is used in dev mode: each instance is given a port range on localhost.
+	// PortRange is used in dev mode: each instance is given a port range on localhost (or on its own address).
 	// Requests for ports via the helpers outside this range will panic.
 	PortRange = 128
 )
@@ -90,7 +90,7 @@ func (ci *ControlInfo) ByAddr(addr net.Addr) *InstanceInfo {
 
 // ByAddrPort returns the InstanceInfo by the given address and port.
 func (ci *ControlInfo) ByAddrPort(ap netip.AddrPort) *InstanceInfo {
-	ip := ap.Addr().String()
+	ip := ap.Addr().Unmap().String()
 	port := ap.Port()
 
 	if ip == "" {
@@ -101,8 +101,8 @@ func (ci *ControlInfo) ByAddrPort(ap netip.AddrPort) *InstanceInfo {
 		// TODO: lots of memcpy
 		instance := ci.Instances[index]
 
-		if flyMachine != "" {
-			// Just match IP in real world, no weird port shenanigans.
+		if flyMachine != "" || localAddress != "" {
+			// Just match IP in real world (or if we have our own address), no weird port shenanigans.
 			if instance.Address == ip {
 				return &instance
 			}